@@ -0,0 +1,259 @@
+// Package checkpoint implements a replay tracker that records the low-water
+// mark of archive objects that have been fully written to kinesis
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3-kinesis-replay/validate"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/sirupsen/logrus"
+)
+
+// Tracker implements a replay tracker that persists, for each archive source,
+// the last key for which it and every preceding key have been completely
+// replayed
+type Tracker struct {
+	// The pending entries and the object they were parsed from
+	entries map[*kinesis.PutRecordsRequestEntry]*object
+	// The checkpoint file path
+	file string
+	// The minimum interval between checkpoint file writes
+	interval time.Duration
+	// A logger instance
+	log logrus.FieldLogger
+	// A mutex to synchronise tracker state
+	mu *sync.Mutex
+	// The replay state of each archive source
+	sources map[string]*source
+	// Whether any low-water mark has advanced since the last write
+	dirty bool
+	// The time of the last checkpoint file write
+	savedAt time.Time
+}
+
+// source describes the replay state of a single archive source
+type source struct {
+	// The current low-water mark
+	key string
+	// The state of objects that have not yet been completed
+	objects map[string]*object
+	// Registered object keys in scan order
+	order []string
+}
+
+// object describes the replay state of a single archive object
+type object struct {
+	// the source the object was read from
+	source string
+	// the object key
+	key string
+	// whether all records for the object have been emitted
+	parsed bool
+	// number of emitted records that have not yet been written
+	pending int
+	// whether the object is complete
+	done bool
+}
+
+// NewTracker returns a new checkpoint tracker
+func NewTracker(c *TrackerConfig) (*Tracker, error) {
+	// validate configuration
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	// create new tracker
+	t := &Tracker{
+		entries:  make(map[*kinesis.PutRecordsRequestEntry]*object),
+		file:     c.File,
+		interval: c.Interval,
+		log:      c.Log,
+		mu:       &sync.Mutex{},
+		sources:  make(map[string]*source),
+	}
+	return t, nil
+}
+
+// Object registers an archive object key in scan order
+func (t *Tracker) Object(src, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sources[src]
+	if !ok {
+		s = &source{objects: make(map[string]*object)}
+		t.sources[src] = s
+	}
+	s.objects[key] = &object{source: src, key: key}
+	s.order = append(s.order, key)
+}
+
+// Record associates a pending kinesis entry with an archive object
+func (t *Tracker) Record(src, key string, entry *kinesis.PutRecordsRequestEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if o := t.object(src, key); o != nil {
+		o.pending++
+		t.entries[entry] = o
+	}
+}
+
+// Parsed marks an archive object as fully parsed
+func (t *Tracker) Parsed(src, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if o := t.object(src, key); o != nil {
+		o.parsed = true
+		t.complete(o)
+	}
+}
+
+// Written marks a kinesis entry as successfully written
+func (t *Tracker) Written(entry *kinesis.PutRecordsRequestEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.entries[entry]
+	if !ok {
+		return
+	}
+	delete(t.entries, entry)
+	o.pending--
+	t.complete(o)
+}
+
+// Close persists the final low-water marks to the checkpoint file
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	err := t.save()
+	if err == nil {
+		t.log.WithField("keys", t.keys()).Infoln("checkpoint saved")
+	}
+	return err
+}
+
+// object returns the state of a registered object
+func (t *Tracker) object(src, key string) *object {
+	if s, ok := t.sources[src]; ok {
+		return s.objects[key]
+	}
+	return nil
+}
+
+// complete marks an object as done if all of its records have been written,
+// advancing its source's low-water mark past any contiguous run of completed
+// objects
+func (t *Tracker) complete(o *object) {
+	if !o.parsed || o.pending > 0 {
+		return
+	}
+	o.done = true
+	s := t.sources[o.source]
+	for len(s.order) > 0 {
+		next := s.objects[s.order[0]]
+		if !next.done {
+			break
+		}
+		delete(s.objects, s.order[0])
+		s.key = s.order[0]
+		s.order = s.order[1:]
+		t.dirty = true
+	}
+	if !t.dirty || time.Since(t.savedAt) < t.interval {
+		return
+	}
+	if err := t.save(); err != nil {
+		t.log.WithError(err).Errorln("error saving checkpoint")
+	}
+}
+
+// keys returns the current low-water mark of each source
+func (t *Tracker) keys() map[string]string {
+	keys := make(map[string]string)
+	for id, s := range t.sources {
+		if s.key != "" {
+			keys[id] = s.key
+		}
+	}
+	return keys
+}
+
+// save atomically writes the current low-water marks to the checkpoint file
+func (t *Tracker) save() error {
+	b, err := json.Marshal(&State{
+		Keys:    t.keys(),
+		Updated: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(t.file), filepath.Base(t.file))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), t.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	t.dirty = false
+	t.savedAt = time.Now()
+	t.log.Debugln("checkpoint saved")
+	return nil
+}
+
+// State describes the contents of a checkpoint file
+type State struct {
+	// The last archive key of each source for which it and all preceding
+	// keys have been completely replayed
+	Keys map[string]string `json:"keys"`
+	// The time the checkpoint was written
+	Updated time.Time `json:"updated"`
+}
+
+// Load reads a checkpoint file
+func Load(file string) (*State, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// TrackerConfig defines a checkpoint tracker configuration
+type TrackerConfig struct {
+	// The checkpoint file path
+	File string `validate:"required"`
+	// The minimum interval between checkpoint file writes
+	Interval time.Duration `validate:"-"`
+	// A tracker scoped logger
+	Log logrus.FieldLogger `validate:"required"`
+}
+
+// NewTrackerConfig returns a tracker config value with appropriate defaults
+func NewTrackerConfig() *TrackerConfig {
+	return &TrackerConfig{
+		Interval: time.Second * 10,
+		Log:      logrus.WithField("package", "checkpoint"),
+	}
+}
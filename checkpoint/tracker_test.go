@@ -0,0 +1,51 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackerLowWaterMark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// create tracker that saves on every advance
+	config := NewTrackerConfig()
+	config.File = filepath.Join(dir, "checkpoint.json")
+	config.Interval = 0
+	config.Log = logrus.WithField("test", true)
+	tracker, err := NewTracker(config)
+	assert.Nil(t, err)
+
+	// register objects in scan order, including an identical key from a
+	// second source
+	tracker.Object("s3://foo/", "a")
+	tracker.Object("s3://foo/", "b")
+	tracker.Object("s3://foo/", "c")
+	tracker.Object("s3://bar/", "a")
+	a, b := &kinesis.PutRecordsRequestEntry{}, &kinesis.PutRecordsRequestEntry{}
+	tracker.Record("s3://foo/", "a", a)
+	tracker.Record("s3://foo/", "b", b)
+	tracker.Parsed("s3://foo/", "a")
+	tracker.Parsed("s3://foo/", "b")
+	tracker.Parsed("s3://foo/", "c")
+
+	// completing a later object must not advance the mark
+	tracker.Written(b)
+	_, err = Load(config.File)
+	assert.True(t, os.IsNotExist(err))
+
+	// completing the first object advances past all completed objects,
+	// independently of other sources
+	tracker.Written(a)
+	state, err := Load(config.File)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"s3://foo/": "c"}, state.Keys)
+}
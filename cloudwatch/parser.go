@@ -0,0 +1,270 @@
+// Package cloudwatch implements a parser for cloudwatch logs subscription
+// payloads delivered to an archive by firehose
+package cloudwatch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/validate"
+	"strings"
+	"sync"
+
+	"github.com/Jeffail/gabs"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// OutputRaw emits each log event's message as a record
+	OutputRaw = "raw"
+	// OutputWrapped emits each log event as a json record that includes the
+	// owner, log group and log stream of its payload
+	OutputWrapped = "wrapped"
+)
+
+const (
+	// messageTypeControl identifies the messages cloudwatch logs sends to
+	// check that a destination is reachable
+	messageTypeControl = "CONTROL_MESSAGE"
+	// messagePrefix prefixes partition key paths into each log event's
+	// json message
+	messagePrefix = "message."
+)
+
+// payload describes a cloudwatch logs subscription payload
+type payload struct {
+	LogEvents           []*event `json:"logEvents"`
+	LogGroup            string   `json:"logGroup"`
+	LogStream           string   `json:"logStream"`
+	MessageType         string   `json:"messageType"`
+	Owner               string   `json:"owner"`
+	SubscriptionFilters []string `json:"subscriptionFilters"`
+}
+
+// event describes a single log event within a payload
+type event struct {
+	ID        string `json:"id"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// wrapped describes a log event along with its payload metadata
+type wrapped struct {
+	ID        string `json:"id"`
+	LogGroup  string `json:"logGroup"`
+	LogStream string `json:"logStream"`
+	Message   string `json:"message"`
+	Owner     string `json:"owner"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Parser implements a parser that emits each log event of the cloudwatch logs
+// subscription payloads in an object as a record
+type Parser struct {
+	// The number of workers to spawn
+	concurrency int
+	// A logger instance
+	log logrus.FieldLogger
+	// How log events are emitted
+	output string
+	// The log event metadata field, or json path within each log event's
+	// message, to use as the partition key
+	partitionKey string
+	// The percentage of partition keys to replay
+	samplePercent float64
+	// An optional tracker to notify of emitted records
+	tracker replay.Tracker
+	// A wait group to synchronise parser workers
+	wg *sync.WaitGroup
+}
+
+// NewParser returns a new cloudwatch logs parser
+func NewParser(c *ParserConfig) (*Parser, error) {
+	// validate config
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Output {
+	case OutputRaw, OutputWrapped:
+	default:
+		return nil, errors.New("invalid output: " + c.Output)
+	}
+	switch {
+	case c.PartitionKey == "id", c.PartitionKey == "logGroup", c.PartitionKey == "logStream":
+	case strings.HasPrefix(c.PartitionKey, messagePrefix) && len(c.PartitionKey) > len(messagePrefix):
+	default:
+		return nil, errors.New("invalid partition key: " + c.PartitionKey)
+	}
+	p := &Parser{
+		concurrency:   c.Concurrency,
+		log:           c.Log,
+		output:        c.Output,
+		partitionKey:  c.PartitionKey,
+		samplePercent: c.SamplePercent,
+		tracker:       c.Tracker,
+		wg:            &sync.WaitGroup{},
+	}
+	return p, nil
+}
+
+// Parse spawns a pool of workers that decode the incoming stream of objects
+// into log events, publishing each to the entries stream. Parse blocks until
+// all objects have been parsed and emitted.
+func (p *Parser) Parse(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for i := 0; i < p.concurrency; i++ {
+		p.wg.Add(1)
+		go p.worker(p.wg, objects, entries)
+	}
+	p.wg.Wait()
+	close(entries)
+}
+
+// worker parses objects until the objects stream is closed
+func (p *Parser) worker(wg *sync.WaitGroup, objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for o := range objects {
+		log := p.log.WithField("key", *o.Object.Key)
+		err := p.parse(o, entries)
+		o.Body.Close()
+		if err != nil {
+			log.WithError(err).Errorln("error reading object")
+			if o.Fail != nil {
+				o.Fail(err)
+			}
+			continue
+		}
+		if p.tracker != nil {
+			p.tracker.Parsed(o.Source, *o.Object.Key)
+		}
+	}
+	wg.Done()
+}
+
+// parse decodes an object's concatenated payloads, emitting each log event
+// of the data messages
+func (p *Parser) parse(o *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) error {
+	log := p.log.WithField("key", *o.Object.Key)
+	r, err := gunzip(o.Body)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(r)
+	for {
+		pl := &payload{}
+		err := d.Decode(pl)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pl.MessageType == messageTypeControl {
+			continue
+		}
+		log := log.WithFields(logrus.Fields{
+			"logGroup":  pl.LogGroup,
+			"logStream": pl.LogStream,
+		})
+		for _, e := range pl.LogEvents {
+			partitionKey := p.key(pl, e)
+			if partitionKey == "" {
+				log.WithField("id", e.ID).Warnln("missing parition key")
+				continue
+			}
+			// skip log events whose partition key is not sampled
+			if !replay.Sampled(partitionKey, p.samplePercent) {
+				continue
+			}
+			data := []byte(e.Message)
+			if p.output == OutputWrapped {
+				data, err = json.Marshal(&wrapped{
+					ID:        e.ID,
+					LogGroup:  pl.LogGroup,
+					LogStream: pl.LogStream,
+					Message:   e.Message,
+					Owner:     pl.Owner,
+					Timestamp: e.Timestamp,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			entry := &kinesis.PutRecordsRequestEntry{
+				PartitionKey: &partitionKey,
+				Data:         data,
+			}
+			if p.tracker != nil {
+				p.tracker.Record(o.Source, *o.Object.Key, entry)
+			}
+			entries <- entry
+		}
+	}
+}
+
+// key returns the partition key of a log event, or an empty string if the
+// event has none
+func (p *Parser) key(pl *payload, e *event) string {
+	switch p.partitionKey {
+	case "id":
+		return e.ID
+	case "logGroup":
+		return pl.LogGroup
+	case "logStream":
+		return pl.LogStream
+	}
+	parsed, err := gabs.ParseJSON([]byte(e.Message))
+	if err != nil {
+		return ""
+	}
+	value := parsed.Path(strings.TrimPrefix(p.partitionKey, messagePrefix)).Data()
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// gunzip returns a reader of an object's payloads, decompressing them if the
+// archive compressed the already gzipped payloads again
+func gunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// ParserConfig defines a cloudwatch logs parser's configuration
+type ParserConfig struct {
+	Concurrency   int                `validate:"required,min=1"`
+	Log           logrus.FieldLogger `validate:"required"`
+	Output        string             `validate:"required"`
+	PartitionKey  string             `validate:"required"`
+	SamplePercent float64            `validate:"min=0,max=100"`
+	Tracker       replay.Tracker     `validate:"-"`
+}
+
+// NewParserConfig returns a new config value with appropriate defaults
+func NewParserConfig() *ParserConfig {
+	return &ParserConfig{
+		Concurrency:  1,
+		Log:          logrus.WithField("package", "cloudwatch"),
+		Output:       OutputRaw,
+		PartitionKey: "logStream",
+	}
+}
@@ -0,0 +1,78 @@
+package cloudwatch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"s3-kinesis-replay/replay"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+const payloads = `{"messageType":"CONTROL_MESSAGE","owner":"CloudwatchLogs","logGroup":"","logStream":"","subscriptionFilters":[],"logEvents":[{"id":"","timestamp":1,"message":"CWL CONTROL MESSAGE: Checking health of destination Firehose."}]}` +
+	`{"messageType":"DATA_MESSAGE","owner":"123456789012","logGroup":"app","logStream":"a","subscriptionFilters":["all"],"logEvents":[{"id":"1","timestamp":2,"message":"{\"user\":\"x\"}"},{"id":"2","timestamp":3,"message":"plain"}]}`
+
+func TestParse(t *testing.T) {
+	// compress the payloads as separate gzip members, as firehose concatenates
+	// them
+	members := &bytes.Buffer{}
+	for _, p := range []string{payloads[:len(payloads)/2], payloads[len(payloads)/2:]} {
+		w := gzip.NewWriter(members)
+		w.Write([]byte(p))
+		w.Close()
+	}
+
+	for _, tc := range []struct {
+		body          []byte
+		output        string
+		partitionKey  string
+		samplePercent float64
+		keys          []string
+		records       []string
+	}{
+		{
+			members.Bytes(), OutputRaw, "logStream", 0,
+			[]string{"a", "a"},
+			[]string{`{"user":"x"}`, "plain"},
+		},
+		{
+			[]byte(payloads), OutputWrapped, "message.user", 0,
+			[]string{"x"},
+			[]string{`{"id":"1","logGroup":"app","logStream":"a","message":"{\"user\":\"x\"}","owner":"123456789012","timestamp":2}`},
+		},
+		// only log events whose partition key is sampled are emitted
+		{
+			[]byte(payloads), OutputRaw, "id", 50,
+			[]string{"1"},
+			[]string{`{"user":"x"}`},
+		},
+	} {
+		config := NewParserConfig()
+		config.Output = tc.output
+		config.PartitionKey = tc.partitionKey
+		config.SamplePercent = tc.samplePercent
+		parser, err := NewParser(config)
+		assert.Nil(t, err)
+
+		objects := make(chan *replay.Object, 1)
+		objects <- &replay.Object{
+			Body:   ioutil.NopCloser(bytes.NewReader(tc.body)),
+			Object: &s3.Object{Key: aws.String("foo")},
+		}
+		close(objects)
+		entries := make(chan *kinesis.PutRecordsRequestEntry)
+		go parser.Parse(objects, entries)
+		keys := []string{}
+		records := []string{}
+		for e := range entries {
+			keys = append(keys, *e.PartitionKey)
+			records = append(records, string(e.Data))
+		}
+		assert.Equal(t, tc.keys, keys)
+		assert.Equal(t, tc.records, records)
+	}
+}
@@ -0,0 +1,414 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"s3-kinesis-replay/checkpoint"
+	"s3-kinesis-replay/local"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/s3"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	S3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// source describes a single s3 archive source
+type source struct {
+	bucket     string
+	endpoint   string
+	inventory  string
+	path       string
+	prefix     string
+	region     string
+	startAfter string
+	stopAt     string
+}
+
+// createArchive creates a new archive value, merging multiple sources into a
+// single archive if necessary
+func createArchive(log logrus.FieldLogger, sess *session.Session, tracker *checkpoint.Tracker, report *s3.Report) replay.Archive {
+	sources, err := createSources()
+	if err != nil {
+		log.WithError(err).Fatalln("invalid archive source")
+	}
+
+	// load checkpoint if resuming
+	var state *checkpoint.State
+	if viper.GetBool("checkpoint.resume") {
+		state, err = checkpoint.Load(viper.GetString("checkpoint.file"))
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Fatalln("error loading checkpoint")
+		}
+		if state == nil || len(state.Keys) == 0 {
+			log.Warnln("no checkpoint found, starting from the beginning")
+		}
+	}
+
+	// create an in-flight byte budget shared by all sources
+	var budget *s3.Budget
+	if maxInflight := viper.GetString("s3.max_inflight_bytes"); maxInflight != "" {
+		n, err := parseBytes(maxInflight)
+		if err != nil || n <= 0 {
+			log.WithError(err).Fatalln("invalid maximum in-flight bytes")
+		}
+		budget = s3.NewBudget(n, log.WithField("package", "s3"))
+	}
+
+	// create an s3 or local archive for each source
+	archives := []replay.Archive{}
+	ids := map[string]bool{}
+	for _, src := range sources {
+		// identify the source, resuming from its checkpoint if available
+		id := s3.SourceID(src.bucket, src.prefix)
+		if src.path != "" {
+			id = local.SourceID(src.path, src.prefix)
+		}
+		if ids[id] {
+			log.WithField("source", id).Fatalln("duplicate archive source")
+		}
+		ids[id] = true
+		startAfter := src.startAfter
+		if state != nil {
+			if key, ok := state.Keys[id]; ok {
+				log.WithFields(logrus.Fields{
+					"key":    key,
+					"source": id,
+				}).Infoln("resuming from checkpoint")
+				startAfter = key
+			}
+		}
+		if src.path != "" {
+			archives = append(archives, createLocalArchive(log, src, id, startAfter, tracker))
+			continue
+		}
+
+		archiveConfig := createArchiveConfig(log)
+		archiveConfig.Bucket = src.bucket
+		archiveConfig.Budget = budget
+		archiveConfig.Client = createS3Client(sess, src.endpoint, src.region)
+		archiveConfig.Inventory = src.inventory
+		if file := viper.GetString("s3.keys_file"); file != "" {
+			keys, skipped, err := readKeys(sess, file, src.bucket)
+			if err != nil {
+				log.WithError(err).Fatalln("error reading keys file")
+			}
+			log.WithFields(logrus.Fields{
+				"bucket":  src.bucket,
+				"skipped": skipped,
+			}).Debugln("skipped keys file rows for other buckets")
+			// a source without keys would otherwise list its whole bucket
+			if len(keys) == 0 {
+				log.WithField("source", id).Infoln("keys file contains no keys for source, skipping")
+				continue
+			}
+			archiveConfig.Keys = keys
+			log.WithFields(logrus.Fields{
+				"keys":   len(keys),
+				"source": id,
+			}).Infoln("replaying keys from keys file")
+		}
+		archiveConfig.Prefix = src.prefix
+		archiveConfig.Source = id
+		archiveConfig.StartAfter = startAfter
+		archiveConfig.StopAt = src.stopAt
+		if tracker != nil {
+			archiveConfig.Tracker = tracker
+		}
+		if report != nil {
+			archiveConfig.Reporter = report
+		}
+		archive, err := s3.NewArchive(archiveConfig)
+		if err != nil {
+			log.WithError(err).Fatalln("error creating archive service")
+		}
+		archives = append(archives, archive)
+	}
+	if len(archives) == 0 {
+		log.Fatalln("keys file contains no keys")
+	}
+	if len(archives) == 1 {
+		return archives[0]
+	}
+
+	// merge sources
+	multiConfig := s3.NewMultiArchiveConfig()
+	multiConfig.Archives = archives
+	multiConfig.Log = log.WithField("package", "s3")
+	if order := viper.GetString("s3.order"); order != "" {
+		multiConfig.Order = order
+	}
+	archive, err := s3.NewMultiArchive(multiConfig)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating archive service")
+	}
+	return archive
+}
+
+// createLocalArchive creates an archive that reads a local directory, tar
+// file or zip file
+func createLocalArchive(log logrus.FieldLogger, src *source, id, startAfter string, tracker *checkpoint.Tracker) replay.Archive {
+	archiveConfig := local.NewArchiveConfig()
+	archiveConfig.Compression = viper.GetString("s3.compression")
+	archiveConfig.Log = log.WithField("package", "local")
+	archiveConfig.Path = src.path
+	archiveConfig.Prefix = src.prefix
+	archiveConfig.Source = id
+	archiveConfig.StartAfter = startAfter
+	archiveConfig.StopAt = src.stopAt
+	archiveConfig.StopAtMode = viper.GetString("s3.stop_at_mode")
+	if tracker != nil {
+		archiveConfig.Tracker = tracker
+	}
+	archive, err := local.NewArchive(archiveConfig)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating archive service")
+	}
+	return archive
+}
+
+// createArchiveConfig creates an archive configuration from the settings
+// shared by all archive sources
+func createArchiveConfig(log logrus.FieldLogger) *s3.ArchiveConfig {
+	archiveConfig := s3.NewArchiveConfig()
+	archiveConfig.Compression = viper.GetString("s3.compression")
+	archiveConfig.Concurrency = viper.GetInt("s3.concurrency")
+	archiveConfig.Log = log.WithField("package", "s3")
+	archiveConfig.Ordered = viper.GetBool("s3.ordered")
+	if viper.IsSet("s3.list_concurrency") {
+		archiveConfig.ListConcurrency = viper.GetInt("s3.list_concurrency")
+	}
+	if viper.IsSet("s3.max_attempts") {
+		archiveConfig.MaxAttempts = viper.GetInt("s3.max_attempts")
+	}
+	if interval := viper.GetDuration("s3.retry_interval"); interval != time.Duration(0) {
+		archiveConfig.RetryInterval = interval
+	}
+	if interval := viper.GetDuration("s3.retry_max_interval"); interval != time.Duration(0) {
+		archiveConfig.RetryMaxInterval = interval
+	}
+	archiveConfig.Restore = viper.GetString("s3.restore")
+	if viper.IsSet("s3.restore_days") {
+		archiveConfig.RestoreDays = viper.GetInt64("s3.restore_days")
+	}
+	if interval := viper.GetDuration("s3.restore_interval"); interval != time.Duration(0) {
+		archiveConfig.RestoreInterval = interval
+	}
+	if maxWait := viper.GetDuration("s3.restore_max_wait"); maxWait != time.Duration(0) {
+		archiveConfig.RestoreMaxWait = maxWait
+	}
+	if tier := viper.GetString("s3.restore_tier"); tier != "" {
+		archiveConfig.RestoreTier = tier
+	}
+	if viper.IsSet("s3.part_concurrency") {
+		archiveConfig.PartConcurrency = viper.GetInt("s3.part_concurrency")
+	}
+	if viper.IsSet("s3.part_size") {
+		archiveConfig.PartSize = viper.GetInt64("s3.part_size")
+	}
+	if from := viper.GetString("s3.from"); from != "" {
+		t, err := parseTime(from)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid time range start")
+		}
+		archiveConfig.From = t
+	}
+	if to := viper.GetString("s3.to"); to != "" {
+		t, err := parseTime(to)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid time range end")
+		}
+		archiveConfig.To = t
+	}
+	archiveConfig.Include = viper.GetStringSlice("s3.include")
+	archiveConfig.IncludeGlob = viper.GetStringSlice("s3.include_glob")
+	archiveConfig.Exclude = viper.GetStringSlice("s3.exclude")
+	archiveConfig.ExcludeGlob = viper.GetStringSlice("s3.exclude_glob")
+	if minSize := viper.GetString("s3.min_size"); minSize != "" {
+		n, err := parseBytes(minSize)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid minimum object size")
+		}
+		archiveConfig.MinSize = n
+	}
+	if maxSize := viper.GetString("s3.max_size"); maxSize != "" {
+		n, err := parseBytes(maxSize)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid maximum object size")
+		}
+		archiveConfig.MaxSize = n
+	}
+	if after := viper.GetString("s3.modified_after"); after != "" {
+		t, err := parseTime(after)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid modified after time")
+		}
+		archiveConfig.ModifiedAfter = t
+	}
+	if before := viper.GetString("s3.modified_before"); before != "" {
+		t, err := parseTime(before)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid modified before time")
+		}
+		archiveConfig.ModifiedBefore = t
+	}
+	if asOf := viper.GetString("s3.as_of"); asOf != "" {
+		t, err := parseTime(asOf)
+		if err != nil {
+			log.WithError(err).Fatalln("invalid as of time")
+		}
+		archiveConfig.AsOf = t
+	}
+	if viper.IsSet("s3.key_template") {
+		archiveConfig.KeyTemplate = viper.GetString("s3.key_template")
+	}
+	archiveConfig.StopAtMode = viper.GetString("s3.stop_at_mode")
+	archiveConfig.SampleEvery = viper.GetInt("s3.sample_every")
+	archiveConfig.SamplePercent = viper.GetFloat64("s3.sample_percent")
+	archiveConfig.ExpectedBucketOwner = viper.GetString("s3.expected_bucket_owner")
+	archiveConfig.RequestPayer = viper.GetBool("s3.requester_pays")
+	if file := viper.GetString("s3.sse_customer_key_file"); file != "" {
+		key, err := readSSECustomerKey(file)
+		if err != nil {
+			log.WithError(err).Fatalln("error reading sse customer key file")
+		}
+		archiveConfig.SSECustomerKey = key
+	}
+	return archiveConfig
+}
+
+// createSources returns the configured archive sources, falling back to the
+// single source described by the top level s3 settings
+func createSources() ([]*source, error) {
+	sources := []*source{}
+	for _, uri := range viper.GetStringSlice("s3.sources") {
+		src, err := parseSource(uri)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		sources = append(sources, &source{
+			bucket:     viper.GetString("s3.bucket"),
+			endpoint:   viper.GetString("s3.endpoint"),
+			inventory:  viper.GetString("s3.inventory"),
+			prefix:     viper.GetString("s3.prefix"),
+			region:     viper.GetString("s3.region"),
+			startAfter: viper.GetString("s3.start_after"),
+			stopAt:     viper.GetString("s3.stop_at"),
+		})
+	}
+	return sources, nil
+}
+
+// parseSource parses an archive source uri of the form
+// s3://<bucket>/<prefix>?region=&endpoint=&inventory=&start_after=&stop_at=, where
+// region and endpoint default to the top level s3 settings, or
+// file://<path>?prefix=&start_after=&stop_at= for a local directory, tar file
+// or zip file
+func parseSource(uri string) (*source, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	if u.Scheme == "file" && u.Host+u.Path != "" {
+		return &source{
+			path:       u.Host + u.Path,
+			prefix:     q.Get("prefix"),
+			startAfter: q.Get("start_after"),
+			stopAt:     q.Get("stop_at"),
+		}, nil
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, errors.New("source must be an s3://<bucket>/<prefix> or file://<path> uri: " + uri)
+	}
+	src := &source{
+		bucket:     u.Host,
+		endpoint:   q.Get("endpoint"),
+		inventory:  q.Get("inventory"),
+		prefix:     strings.TrimPrefix(u.Path, "/"),
+		region:     q.Get("region"),
+		startAfter: q.Get("start_after"),
+		stopAt:     q.Get("stop_at"),
+	}
+	if src.endpoint == "" {
+		src.endpoint = viper.GetString("s3.endpoint")
+	}
+	if src.region == "" {
+		src.region = viper.GetString("s3.region")
+	}
+	return src, nil
+}
+
+// readKeys reads an explicit list of archive keys from a local file or an
+// s3://<bucket>/<key> uri
+func readKeys(sess *session.Session, file, bucket string) ([]string, int, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(file, "s3://") {
+		u, err := url.Parse(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		client := createS3Client(sess, viper.GetString("s3.endpoint"), viper.GetString("s3.region"))
+		output, err := client.GetObject(&S3.GetObjectInput{
+			Bucket: aws.String(u.Host),
+			Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		r = output.Body
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = f
+	}
+	defer r.Close()
+	return s3.ReadKeys(r, bucket)
+}
+
+// readSSECustomerKey reads a 256-bit SSE-C customer key file containing either
+// the raw key or its base64 encoding
+func readSSECustomerKey(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 32 {
+		return string(data), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return "", errors.New("sse customer key must be 32 raw or base64 encoded bytes")
+	}
+	return string(key), nil
+}
+
+// createS3Client creates a new s3 client using the given session
+func createS3Client(sess *session.Session, endpoint, region string) s3iface.S3API {
+	config := aws.NewConfig()
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	if viper.GetBool("s3.path_style") {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	client := S3.New(sess, config)
+	return client
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"errors"
+	"regexp"
+	"s3-kinesis-replay/checkpoint"
+	"s3-kinesis-replay/cloudwatch"
+	"s3-kinesis-replay/csv"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/route"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// autoRoutes are the routes appended to any configured routes when the
+// parser format is auto
+var autoRoutes = []string{
+	"cloudwatch;magic=^\\s*\\{\\s*\"messageType\"",
+	"csv;content_type=text/csv",
+	"csv;key=(?i)\\.csv(\\.\\w+)?$",
+	"json;content_type=application/json",
+	"json;magic=^\\s*[\\[{]",
+}
+
+// createParser returns the configured parser, routing objects between
+// parsers if routes are configured or the format is auto
+func createParser(log logrus.FieldLogger, tracker *checkpoint.Tracker) replay.Parser {
+	format := viper.GetString("parser.format")
+	specs := viper.GetStringSlice("parser.routes")
+	if format == "auto" {
+		// only detect formats whose partition key is configured
+		for _, spec := range autoRoutes {
+			if f := strings.SplitN(spec, ";", 2)[0]; viper.GetString(f+".partition_key") != "" {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	// parsers without setting overrides are shared between routes
+	parsers := map[string]replay.Parser{}
+	get := func(format string, settings map[string]string) replay.Parser {
+		if len(settings) == 0 && parsers[format] != nil {
+			return parsers[format]
+		}
+		var p replay.Parser
+		switch format {
+		case "cloudwatch":
+			p = createCloudWatchParser(log, tracker, settings)
+		case "csv":
+			p = createCSVParser(log, tracker, settings)
+		case "json":
+			p = createJSONParser(log, tracker, settings)
+		default:
+			log.WithField("format", format).Fatalln("invalid format")
+		}
+		if len(settings) == 0 {
+			parsers[format] = p
+		}
+		return p
+	}
+	if len(specs) == 0 {
+		return get(format, nil)
+	}
+
+	config := route.NewRouterConfig()
+	if tracker != nil {
+		config.Tracker = tracker
+	}
+	config.Log = log.WithField("package", "route")
+	config.Ordered = viper.GetBool("s3.ordered")
+	for _, spec := range specs {
+		r, format, settings, err := parseRoute(spec)
+		if err != nil {
+			log.WithError(err).WithField("route", spec).Fatalln("invalid route")
+		}
+		r.Parser = get(format, settings)
+		config.Routes = append(config.Routes, r)
+	}
+	if format != "auto" {
+		config.Default = get(format, nil)
+	}
+	router, err := route.NewRouter(config)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating router")
+	}
+	return router
+}
+
+// parseRoute parses a route of the form <format>[;<name>=<value>...], where
+// key, content_type and magic define the route's conditions and any other
+// names override the parser's settings
+func parseRoute(spec string) (*route.Route, string, map[string]string, error) {
+	parts := strings.Split(spec, ";")
+	format := parts[0]
+	if format != "cloudwatch" && format != "csv" && format != "json" {
+		return nil, "", nil, errors.New("invalid route format: " + format)
+	}
+	r := &route.Route{Name: spec}
+	settings := map[string]string{}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, "", nil, errors.New("invalid route setting: " + part)
+		}
+		var err error
+		switch kv[0] {
+		case "content_type":
+			r.ContentType = kv[1]
+		case "key":
+			r.Key, err = regexp.Compile(kv[1])
+		case "magic":
+			r.Magic, err = regexp.Compile(kv[1])
+		case "partition_key":
+			settings[kv[0]] = kv[1]
+		case "output":
+			if format != "cloudwatch" {
+				err = errors.New("output is only supported by cloudwatch routes")
+			}
+			settings[kv[0]] = kv[1]
+		case "header":
+			if format != "csv" {
+				err = errors.New("header is only supported by csv routes")
+			}
+			settings[kv[0]] = kv[1]
+		case "deaggregate", "delimiter", "framing", "records_path", "schema":
+			if format != "json" {
+				err = errors.New(kv[0] + " is only supported by json routes")
+			}
+			settings[kv[0]] = kv[1]
+		default:
+			err = errors.New("unknown route setting: " + kv[0])
+		}
+		if err != nil {
+			return nil, "", nil, err
+		}
+	}
+	return r, format, settings, nil
+}
+
+// createCloudWatchParser returns a new cloudwatch logs parser, applying any
+// route setting overrides
+func createCloudWatchParser(log logrus.FieldLogger, tracker *checkpoint.Tracker, settings map[string]string) replay.Parser {
+	config := cloudwatch.NewParserConfig()
+	if tracker != nil {
+		config.Tracker = tracker
+	}
+	config.Log = log.WithField("package", "cloudwatch")
+	if viper.IsSet("cloudwatch.concurrency") {
+		config.Concurrency = viper.GetInt("cloudwatch.concurrency")
+	}
+	// a single worker emits log events in object order
+	if viper.GetBool("s3.ordered") {
+		config.Concurrency = 1
+	}
+	if output := viper.GetString("cloudwatch.output"); output != "" {
+		config.Output = output
+	}
+	if partitionKey := viper.GetString("cloudwatch.partition_key"); partitionKey != "" {
+		config.PartitionKey = partitionKey
+	}
+	config.SamplePercent = viper.GetFloat64("json.sample_percent")
+	if output, ok := settings["output"]; ok {
+		config.Output = output
+	}
+	if partitionKey, ok := settings["partition_key"]; ok {
+		config.PartitionKey = partitionKey
+	}
+	parser, err := cloudwatch.NewParser(config)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating cloudwatch parser")
+	}
+	return parser
+}
+
+// createCSVParser returns a new csv parser, applying any route setting
+// overrides
+func createCSVParser(log logrus.FieldLogger, tracker *checkpoint.Tracker, settings map[string]string) replay.Parser {
+	config := csv.NewParserConfig()
+	if tracker != nil {
+		config.Tracker = tracker
+	}
+	config.Header = viper.GetBool("csv.header")
+	config.Log = log.WithField("package", "csv")
+	config.PartitionKey = viper.GetString("csv.partition_key")
+	config.SamplePercent = viper.GetFloat64("json.sample_percent")
+	if viper.IsSet("csv.concurrency") {
+		config.Concurrency = viper.GetInt("csv.concurrency")
+	}
+	// a single worker emits rows in object order
+	if viper.GetBool("s3.ordered") {
+		config.Concurrency = 1
+	}
+	if header, ok := settings["header"]; ok {
+		h, err := strconv.ParseBool(header)
+		if err != nil {
+			log.WithError(err).Fatalln("error creating csv parser")
+		}
+		config.Header = h
+	}
+	if partitionKey, ok := settings["partition_key"]; ok {
+		config.PartitionKey = partitionKey
+	}
+	parser, err := csv.NewParser(config)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating csv parser")
+	}
+	return parser
+}
@@ -3,19 +3,18 @@ package cmd
 import (
 	"errors"
 	"regexp"
+	"s3-kinesis-replay/checkpoint"
 	"s3-kinesis-replay/json"
 	"s3-kinesis-replay/kinesis"
 	"s3-kinesis-replay/replay"
 	"s3-kinesis-replay/s3"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	Kinesis "github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
-	S3 "github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -30,71 +29,68 @@ var rootCmd = &cobra.Command{
 		// create application logger
 		log := createLogger()
 
-		// create aws session
-		sess := session.Must(session.NewSession())
+		// create separate aws sessions for the archive and target stream
+		s3Sess := createSession(log, "s3")
+		kinesisSess := createSession(log, "kinesis")
 
-		// create s3 client and downloader
+		// create checkpoint tracker if enabled
+		var tracker *checkpoint.Tracker
+		if viper.GetString("checkpoint.file") != "" {
+			tracker = createTracker(log)
+		}
+
+		// create failed objects report if enabled
+		var report *s3.Report
+		if viper.GetString("s3.failed_report") != "" {
+			report = createReport(log)
+		}
+
+		// create s3 archive
 		var archive replay.Archive
-		s3client := createS3Client(sess)
-		s3downloader := createDownloader(s3client)
-		archive = createArchive(log, s3client, s3downloader)
+		archive = createArchive(log, s3Sess, tracker, report)
 
 		// create kinesis client
 		var producer replay.Producer
-		kinesisClient := createKinesisClient(sess)
-		producer = createProducer(log, kinesisClient)
+		kinesisClient := createKinesisClient(kinesisSess)
+		producer = createProducer(log, kinesisClient, tracker)
 
 		// create parser
 		var parser replay.Parser
-		format := viper.GetString("parser.format")
-		if format == "json" {
-			parser = createJSONParser(log)
-		} else {
-			log.Fatalln("invalid format")
-		}
+		parser = createParser(log, tracker)
 
 		// bootstrap application
 		parser.Parse(archive.Scan(), producer.Stream())
 		producer.Wait()
+		if tracker != nil {
+			if err := tracker.Close(); err != nil {
+				log.WithError(err).Errorln("error saving checkpoint")
+			}
+		}
+		if report != nil {
+			if err := report.Close(); err != nil {
+				log.WithError(err).Errorln("error writing failed objects report")
+			}
+		}
 		log.Infoln("replay completed")
 	},
 }
 
-// createArchive creates a new archive value
-func createArchive(log logrus.FieldLogger, client s3iface.S3API, downloader s3.Downloader) replay.Archive {
-	// create s3 archive
-	archiveConfig := s3.NewArchiveConfig()
-	archiveConfig.Bucket = viper.GetString("s3.bucket")
-	archiveConfig.Concurrency = viper.GetInt("s3.concurrency")
-	archiveConfig.Client = client
-	archiveConfig.Downloader = downloader
-	archiveConfig.Log = log.WithField("package", "s3")
-	if viper.IsSet("s3.prefix") {
-		archiveConfig.Prefix = viper.GetString("s3.prefix")
-	}
-	if viper.IsSet("s3.start_after") {
-		archiveConfig.StartAfter = viper.GetString("s3.start_after")
-	}
-	if viper.IsSet("s3.stop_at") {
-		archiveConfig.StopAt = viper.GetString("s3.stop_at")
-	}
-	archive, err := s3.NewArchive(archiveConfig)
-	if err != nil {
-		log.WithError(err).Fatalln("error creating archive service")
-	}
-	return archive
-}
-
-// createDownloader returns a new s3 downloader
-func createDownloader(client s3iface.S3API) s3.Downloader {
-	return s3manager.NewDownloaderWithClient(client)
-}
-
-// createJSONParser returns a new json parser
-func createJSONParser(log logrus.FieldLogger) replay.Parser {
+// createJSONParser returns a new json parser, applying any route setting
+// overrides
+func createJSONParser(log logrus.FieldLogger, tracker *checkpoint.Tracker, settings map[string]string) replay.Parser {
 	config := json.NewParserConfig()
+	if tracker != nil {
+		config.Tracker = tracker
+	}
+	config.Deaggregate = viper.GetBool("json.deaggregate")
 	config.Log = log.WithField("package", "json")
+	if framing := viper.GetString("json.framing"); framing != "" {
+		config.Framing = framing
+	}
+	config.Ordered = viper.GetBool("s3.ordered")
 	config.PartitionKey = viper.GetString("json.partition_key")
+	config.RecordsPath = viper.GetString("json.records_path")
+	config.SamplePercent = viper.GetFloat64("json.sample_percent")
 	config.Schema = viper.GetString("json.schema")
 	if viper.IsSet("json.concurrency") {
 		config.Concurrency = viper.GetInt("json.concurrency")
@@ -111,6 +107,28 @@ func createJSONParser(log logrus.FieldLogger) replay.Parser {
 		config.Replace = regexp.MustCompile(viper.GetString("parser.replace"))
 		config.ReplaceWith = replaceWith
 	}
+	if deaggregate, ok := settings["deaggregate"]; ok {
+		d, err := strconv.ParseBool(deaggregate)
+		if err != nil {
+			log.WithError(err).Fatalln("error creating json parser")
+		}
+		config.Deaggregate = d
+	}
+	if delimiter, ok := settings["delimiter"]; ok {
+		config.Delimiter = regexp.MustCompile(delimiter)
+	}
+	if framing, ok := settings["framing"]; ok {
+		config.Framing = framing
+	}
+	if partitionKey, ok := settings["partition_key"]; ok {
+		config.PartitionKey = partitionKey
+	}
+	if recordsPath, ok := settings["records_path"]; ok {
+		config.RecordsPath = recordsPath
+	}
+	if schema, ok := settings["schema"]; ok {
+		config.Schema = schema
+	}
 	parser, err := json.NewParser(config)
 	if err != nil {
 		log.WithError(err).Fatalln("error creating json parser")
@@ -162,11 +180,15 @@ func createLogger() logrus.FieldLogger {
 }
 
 // createProducer creates a new producer value
-func createProducer(log logrus.FieldLogger, client kinesisiface.KinesisAPI) replay.Producer {
+func createProducer(log logrus.FieldLogger, client kinesisiface.KinesisAPI, tracker *checkpoint.Tracker) replay.Producer {
 	config := kinesis.NewProducerConfig()
+	if tracker != nil {
+		config.Tracker = tracker
+	}
 	config.Client = client
 	config.Log = log.WithField("package", "kinesis")
 	config.StreamName = viper.GetString("kinesis.stream_name")
+	config.AggregateSize = viper.GetInt("kinesis.aggregate_size")
 	if backoffInterval := viper.GetDuration("kinesis.backoff_interval"); backoffInterval != time.Duration(0) {
 		config.BackoffInterval = backoffInterval
 	}
@@ -176,6 +198,9 @@ func createProducer(log logrus.FieldLogger, client kinesisiface.KinesisAPI) repl
 	if bufferWindow := viper.GetDuration("kinesis.buffer_window"); bufferWindow != time.Duration(0) {
 		config.BufferWindow = bufferWindow
 	}
+	if shardRefreshInterval := viper.GetDuration("kinesis.shard_refresh_interval"); shardRefreshInterval != time.Duration(0) {
+		config.ShardRefreshInterval = shardRefreshInterval
+	}
 	producer, err := kinesis.NewProducer(config)
 	if err != nil {
 		log.WithError(err).Fatalln("error creating producer")
@@ -183,17 +208,31 @@ func createProducer(log logrus.FieldLogger, client kinesisiface.KinesisAPI) repl
 	return producer
 }
 
-// createS3Client creates a new s3 client using the given session
-func createS3Client(sess *session.Session) s3iface.S3API {
-	config := aws.NewConfig()
-	if endpoint := viper.GetString("s3.endpoint"); endpoint != "" {
-		config.Endpoint = aws.String(endpoint)
+// createTracker creates a new checkpoint tracker
+func createTracker(log logrus.FieldLogger) *checkpoint.Tracker {
+	config := checkpoint.NewTrackerConfig()
+	config.File = viper.GetString("checkpoint.file")
+	config.Log = log.WithField("package", "checkpoint")
+	if interval := viper.GetDuration("checkpoint.interval"); interval != time.Duration(0) {
+		config.Interval = interval
 	}
-	if region := viper.GetString("s3.region"); region != "" {
-		config.Region = aws.String(region)
+	tracker, err := checkpoint.NewTracker(config)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating checkpoint tracker")
 	}
-	client := S3.New(sess, config)
-	return client
+	return tracker
+}
+
+// createReport returns a new failed objects report
+func createReport(log logrus.FieldLogger) *s3.Report {
+	config := s3.NewReportConfig()
+	config.File = viper.GetString("s3.failed_report")
+	config.Log = log.WithField("package", "s3")
+	report, err := s3.NewReport(config)
+	if err != nil {
+		log.WithError(err).Fatalln("error creating failed objects report")
+	}
+	return report
 }
 
 // Execute the root command
@@ -203,15 +242,57 @@ func Execute() {
 
 // bind cli flags to application configuration
 func init() {
+	rootCmd.Flags().String("checkpoint-file", "", "checkpoint file path")
+	viper.BindPFlag("checkpoint.file", rootCmd.Flags().Lookup("checkpoint-file"))
+
+	rootCmd.Flags().String("checkpoint-interval", "", "minimum interval between checkpoint writes")
+	viper.BindPFlag("checkpoint.interval", rootCmd.Flags().Lookup("checkpoint-interval"))
+
+	rootCmd.Flags().Bool("resume", false, "resume replay from the checkpoint file")
+	viper.BindPFlag("checkpoint.resume", rootCmd.Flags().Lookup("resume"))
+
+	rootCmd.Flags().Int("cloudwatch-concurrency", 4, "cloudwatch logs parser concurrency")
+	viper.BindPFlag("cloudwatch.concurrency", rootCmd.Flags().Lookup("cloudwatch-concurrency"))
+
+	rootCmd.Flags().String("cloudwatch-output", "", "cloudwatch logs parser output mode")
+	viper.BindPFlag("cloudwatch.output", rootCmd.Flags().Lookup("cloudwatch-output"))
+
+	rootCmd.Flags().String("cloudwatch-partition-key", "", "cloudwatch logs parser partition key")
+	viper.BindPFlag("cloudwatch.partition_key", rootCmd.Flags().Lookup("cloudwatch-partition-key"))
+
+	rootCmd.Flags().Int("csv-concurrency", 4, "csv parser concurrency")
+	viper.BindPFlag("csv.concurrency", rootCmd.Flags().Lookup("csv-concurrency"))
+
+	rootCmd.Flags().Bool("csv-header", false, "csv parser objects have a header row")
+	viper.BindPFlag("csv.header", rootCmd.Flags().Lookup("csv-header"))
+
+	rootCmd.Flags().String("csv-partition-key", "", "csv parser partition key column name or index")
+	viper.BindPFlag("csv.partition_key", rootCmd.Flags().Lookup("csv-partition-key"))
+
+	rootCmd.Flags().Bool("deaggregate", false, "json parser kpl aggregated record expansion")
+	viper.BindPFlag("json.deaggregate", rootCmd.Flags().Lookup("deaggregate"))
+
 	rootCmd.Flags().Int("json-concurrency", 4, "json parser concurrency")
 	viper.BindPFlag("json.concurrency", rootCmd.Flags().Lookup("json-concurrency"))
 
+	rootCmd.Flags().String("json-framing", "", "json parser record framing")
+	viper.BindPFlag("json.framing", rootCmd.Flags().Lookup("json-framing"))
+
 	rootCmd.Flags().String("partition-key", "", "json parser parition key path")
 	viper.BindPFlag("json.partition_key", rootCmd.Flags().Lookup("partition-key"))
 
+	rootCmd.Flags().String("records-path", "", "json parser envelope records path")
+	viper.BindPFlag("json.records_path", rootCmd.Flags().Lookup("records-path"))
+
+	rootCmd.Flags().Float64("sample-records-percent", 0, "percentage of partition keys to replay")
+	viper.BindPFlag("json.sample_percent", rootCmd.Flags().Lookup("sample-records-percent"))
+
 	rootCmd.Flags().String("json-schema", "", "json parser schema path")
 	viper.BindPFlag("json.schema", rootCmd.Flags().Lookup("json-schema"))
 
+	rootCmd.Flags().Int("kinesis-aggregate-size", 0, "kinesis kpl aggregated record size")
+	viper.BindPFlag("kinesis.aggregate_size", rootCmd.Flags().Lookup("kinesis-aggregate-size"))
+
 	rootCmd.Flags().String("kinesis-backoff-interval", "", "kinesis backoff interval")
 	viper.BindPFlag("kinesis.backoff_interval", rootCmd.Flags().Lookup("kinesis-backoff-interval"))
 
@@ -224,9 +305,27 @@ func init() {
 	rootCmd.Flags().String("kinesis-endpoint", "", "kinesis endpoint override")
 	viper.BindPFlag("kinesis.endpoint", rootCmd.Flags().Lookup("kinesis-endpoint"))
 
+	rootCmd.Flags().String("kinesis-external-id", "", "kinesis assumed role external id")
+	viper.BindPFlag("kinesis.external_id", rootCmd.Flags().Lookup("kinesis-external-id"))
+
+	rootCmd.Flags().String("kinesis-profile", "", "kinesis shared config profile")
+	viper.BindPFlag("kinesis.profile", rootCmd.Flags().Lookup("kinesis-profile"))
+
 	rootCmd.Flags().String("kinesis-region", "", "kinesis region override")
 	viper.BindPFlag("kinesis.region", rootCmd.Flags().Lookup("kinesis-region"))
 
+	rootCmd.Flags().String("kinesis-role-arn", "", "kinesis role arn to assume")
+	viper.BindPFlag("kinesis.role_arn", rootCmd.Flags().Lookup("kinesis-role-arn"))
+
+	rootCmd.Flags().String("kinesis-role-duration", "", "kinesis assumed role session duration")
+	viper.BindPFlag("kinesis.role_duration", rootCmd.Flags().Lookup("kinesis-role-duration"))
+
+	rootCmd.Flags().String("kinesis-role-session-name", "", "kinesis assumed role session name")
+	viper.BindPFlag("kinesis.role_session_name", rootCmd.Flags().Lookup("kinesis-role-session-name"))
+
+	rootCmd.Flags().String("kinesis-shard-refresh-interval", "", "kinesis shard refresh interval")
+	viper.BindPFlag("kinesis.shard_refresh_interval", rootCmd.Flags().Lookup("kinesis-shard-refresh-interval"))
+
 	rootCmd.Flags().String("stream-name", "", "target kinesis stream name")
 	viper.BindPFlag("kinesis.stream_name", rootCmd.Flags().Lookup("stream-name"))
 
@@ -245,40 +344,191 @@ func init() {
 	rootCmd.Flags().String("replace-with", "", "optional replacement string")
 	viper.BindPFlag("parser.replace_with", rootCmd.Flags().Lookup("replace-with"))
 
+	rootCmd.Flags().StringSlice("route", nil, "parser route for matching objects")
+	viper.BindPFlag("parser.routes", rootCmd.Flags().Lookup("route"))
+
+	rootCmd.Flags().String("as-of", "", "s3 archive point in time for versioned buckets")
+	viper.BindPFlag("s3.as_of", rootCmd.Flags().Lookup("as-of"))
+
 	rootCmd.Flags().String("bucket", "", "s3 archive bucket name")
 	viper.BindPFlag("s3.bucket", rootCmd.Flags().Lookup("bucket"))
 
+	rootCmd.Flags().String("compression", "", "s3 archive compression format override")
+	viper.BindPFlag("s3.compression", rootCmd.Flags().Lookup("compression"))
+
 	rootCmd.Flags().Int("s3-concurrency", 4, "s3 download concurrency")
 	viper.BindPFlag("s3.concurrency", rootCmd.Flags().Lookup("s3-concurrency"))
 
+	rootCmd.Flags().StringSlice("exclude", nil, "s3 archive key exclude regexp")
+	viper.BindPFlag("s3.exclude", rootCmd.Flags().Lookup("exclude"))
+
+	rootCmd.Flags().StringSlice("exclude-glob", nil, "s3 archive key exclude glob")
+	viper.BindPFlag("s3.exclude_glob", rootCmd.Flags().Lookup("exclude-glob"))
+
+	rootCmd.Flags().String("failed-report", "", "s3 failed objects report file path")
+	viper.BindPFlag("s3.failed_report", rootCmd.Flags().Lookup("failed-report"))
+
+	rootCmd.Flags().String("expected-bucket-owner", "", "s3 archive expected bucket owner account id")
+	viper.BindPFlag("s3.expected_bucket_owner", rootCmd.Flags().Lookup("expected-bucket-owner"))
+
+	rootCmd.Flags().String("from", "", "s3 archive time range start")
+	viper.BindPFlag("s3.from", rootCmd.Flags().Lookup("from"))
+
+	rootCmd.Flags().StringSlice("include", nil, "s3 archive key include regexp")
+	viper.BindPFlag("s3.include", rootCmd.Flags().Lookup("include"))
+
+	rootCmd.Flags().StringSlice("include-glob", nil, "s3 archive key include glob")
+	viper.BindPFlag("s3.include_glob", rootCmd.Flags().Lookup("include-glob"))
+
+	rootCmd.Flags().String("inventory", "", "s3 inventory manifest uri")
+	viper.BindPFlag("s3.inventory", rootCmd.Flags().Lookup("inventory"))
+
+	rootCmd.Flags().String("keys-file", "", "s3 archive keys file path or uri")
+	viper.BindPFlag("s3.keys_file", rootCmd.Flags().Lookup("keys-file"))
+
+	rootCmd.Flags().String("key-template", "", "s3 archive date-partitioned key time layout")
+	viper.BindPFlag("s3.key_template", rootCmd.Flags().Lookup("key-template"))
+
+	rootCmd.Flags().Int("s3-list-concurrency", 1, "s3 prefix listing concurrency")
+	viper.BindPFlag("s3.list_concurrency", rootCmd.Flags().Lookup("s3-list-concurrency"))
+
+	rootCmd.Flags().Int("s3-max-attempts", 5, "s3 download attempts per object")
+	viper.BindPFlag("s3.max_attempts", rootCmd.Flags().Lookup("s3-max-attempts"))
+
+	rootCmd.Flags().String("max-inflight-bytes", "", "s3 archive maximum in-flight bytes")
+	viper.BindPFlag("s3.max_inflight_bytes", rootCmd.Flags().Lookup("max-inflight-bytes"))
+
+	rootCmd.Flags().String("max-size", "", "s3 archive maximum object size")
+	viper.BindPFlag("s3.max_size", rootCmd.Flags().Lookup("max-size"))
+
+	rootCmd.Flags().String("min-size", "", "s3 archive minimum object size")
+	viper.BindPFlag("s3.min_size", rootCmd.Flags().Lookup("min-size"))
+
+	rootCmd.Flags().String("modified-after", "", "s3 archive minimum object last modified time")
+	viper.BindPFlag("s3.modified_after", rootCmd.Flags().Lookup("modified-after"))
+
+	rootCmd.Flags().String("modified-before", "", "s3 archive maximum object last modified time")
+	viper.BindPFlag("s3.modified_before", rootCmd.Flags().Lookup("modified-before"))
+
+	rootCmd.Flags().Int("s3-part-concurrency", 1, "s3 ranged GET concurrency per object")
+	viper.BindPFlag("s3.part_concurrency", rootCmd.Flags().Lookup("s3-part-concurrency"))
+
+	rootCmd.Flags().Int64("s3-part-size", 8388608, "s3 ranged GET size in bytes")
+	viper.BindPFlag("s3.part_size", rootCmd.Flags().Lookup("s3-part-size"))
+
+	rootCmd.Flags().Bool("ordered", false, "replay objects and records in key order")
+	viper.BindPFlag("s3.ordered", rootCmd.Flags().Lookup("ordered"))
+
 	rootCmd.Flags().String("prefix", "", "s3 archive prefix")
 	viper.BindPFlag("s3.prefix", rootCmd.Flags().Lookup("prefix"))
 
+	rootCmd.Flags().Bool("requester-pays", false, "accept s3 requester pays charges")
+	viper.BindPFlag("s3.requester_pays", rootCmd.Flags().Lookup("requester-pays"))
+
+	rootCmd.Flags().String("restore", "", "s3 archived object restore mode")
+	viper.BindPFlag("s3.restore", rootCmd.Flags().Lookup("restore"))
+
+	rootCmd.Flags().Int64("restore-days", 1, "s3 restored object lifetime in days")
+	viper.BindPFlag("s3.restore_days", rootCmd.Flags().Lookup("restore-days"))
+
+	rootCmd.Flags().String("restore-interval", "", "s3 restore status poll interval")
+	viper.BindPFlag("s3.restore_interval", rootCmd.Flags().Lookup("restore-interval"))
+
+	rootCmd.Flags().String("restore-max-wait", "", "s3 maximum wait for a restore to complete")
+	viper.BindPFlag("s3.restore_max_wait", rootCmd.Flags().Lookup("restore-max-wait"))
+
+	rootCmd.Flags().String("restore-tier", "", "s3 restore retrieval tier")
+	viper.BindPFlag("s3.restore_tier", rootCmd.Flags().Lookup("restore-tier"))
+
+	rootCmd.Flags().String("s3-ca-bundle", "", "s3 custom CA bundle path")
+	viper.BindPFlag("s3.ca_bundle", rootCmd.Flags().Lookup("s3-ca-bundle"))
+
+	rootCmd.Flags().String("s3-endpoint", "", "s3 endpoint override")
+	viper.BindPFlag("s3.endpoint", rootCmd.Flags().Lookup("s3-endpoint"))
+
+	rootCmd.Flags().String("s3-external-id", "", "s3 assumed role external id")
+	viper.BindPFlag("s3.external_id", rootCmd.Flags().Lookup("s3-external-id"))
+
+	rootCmd.Flags().Bool("s3-path-style", false, "use s3 path-style addressing")
+	viper.BindPFlag("s3.path_style", rootCmd.Flags().Lookup("s3-path-style"))
+
+	rootCmd.Flags().String("s3-profile", "", "s3 shared config profile")
+	viper.BindPFlag("s3.profile", rootCmd.Flags().Lookup("s3-profile"))
+
+	rootCmd.Flags().String("s3-retry-interval", "", "s3 download retry interval")
+	viper.BindPFlag("s3.retry_interval", rootCmd.Flags().Lookup("s3-retry-interval"))
+
+	rootCmd.Flags().String("s3-retry-max-interval", "", "s3 download max retry interval")
+	viper.BindPFlag("s3.retry_max_interval", rootCmd.Flags().Lookup("s3-retry-max-interval"))
+
 	rootCmd.Flags().String("s3-region", "", "s3 archive region")
 	viper.BindPFlag("s3.region", rootCmd.Flags().Lookup("s3-region"))
 
+	rootCmd.Flags().String("s3-role-arn", "", "s3 role arn to assume")
+	viper.BindPFlag("s3.role_arn", rootCmd.Flags().Lookup("s3-role-arn"))
+
+	rootCmd.Flags().String("s3-role-duration", "", "s3 assumed role session duration")
+	viper.BindPFlag("s3.role_duration", rootCmd.Flags().Lookup("s3-role-duration"))
+
+	rootCmd.Flags().String("s3-role-session-name", "", "s3 assumed role session name")
+	viper.BindPFlag("s3.role_session_name", rootCmd.Flags().Lookup("s3-role-session-name"))
+
+	rootCmd.Flags().String("sse-customer-key-file", "", "s3 SSE-C customer key file path")
+	viper.BindPFlag("s3.sse_customer_key_file", rootCmd.Flags().Lookup("sse-customer-key-file"))
+
+	rootCmd.Flags().Int("sample-every", 0, "s3 archive object sampling interval")
+	viper.BindPFlag("s3.sample_every", rootCmd.Flags().Lookup("sample-every"))
+
+	rootCmd.Flags().Float64("sample-percent", 0, "s3 archive percentage of objects to replay")
+	viper.BindPFlag("s3.sample_percent", rootCmd.Flags().Lookup("sample-percent"))
+
 	rootCmd.Flags().String("start-after", "", "s3 archive start-after key")
 	viper.BindPFlag("s3.start_after", rootCmd.Flags().Lookup("start-after"))
 
+	rootCmd.Flags().StringSlice("source", nil, "s3 archive source uri")
+	viper.BindPFlag("s3.sources", rootCmd.Flags().Lookup("source"))
+
+	rootCmd.Flags().String("source-order", "", "s3 archive multi-source order")
+	viper.BindPFlag("s3.order", rootCmd.Flags().Lookup("source-order"))
+
 	rootCmd.Flags().String("stop-at", "", "s3 archive stop-at key")
 	viper.BindPFlag("s3.stop_at", rootCmd.Flags().Lookup("stop-at"))
+
+	rootCmd.Flags().String("stop-at-mode", "", "s3 archive stop-at bound mode")
+	viper.BindPFlag("s3.stop_at_mode", rootCmd.Flags().Lookup("stop-at-mode"))
+
+	rootCmd.Flags().String("to", "", "s3 archive time range end")
+	viper.BindPFlag("s3.to", rootCmd.Flags().Lookup("to"))
 }
 
 // validateConfig handles validating runtime configuration
 func validateConfig(cmd *cobra.Command, args []string) error {
-	validFormats := regexp.MustCompile("^(json)$")
+	validFormats := regexp.MustCompile("^(auto|cloudwatch|csv|json)$")
 	// validate parser format
 	parserFormat := viper.GetString("parser.format")
 	if !validFormats.MatchString(parserFormat) {
 		return errors.New("invalid parser format")
 	}
+	if parserFormat == "csv" && viper.GetString("csv.partition_key") == "" {
+		return errors.New("csv partition key is required")
+	}
 	// validate kinesis configuration
 	if !viper.IsSet("kinesis.stream_name") {
 		return errors.New("kinesis stream name is required")
 	}
 	// validate s3 configuration
-	if !viper.IsSet("s3.bucket") {
-		return errors.New("s3 bucket is required")
+	if !viper.IsSet("s3.bucket") && len(viper.GetStringSlice("s3.sources")) == 0 {
+		return errors.New("s3 bucket or sources are required")
+	}
+	if viper.GetString("s3.keys_file") != "" && viper.GetString("s3.inventory") != "" {
+		return errors.New("s3 keys file cannot be used with an inventory")
+	}
+	if viper.GetString("s3.to") != "" && viper.GetString("s3.from") == "" {
+		return errors.New("s3 time range end requires a start")
+	}
+	// validate checkpoint configuration
+	if viper.GetBool("checkpoint.resume") && viper.GetString("checkpoint.file") == "" {
+		return errors.New("checkpoint file is required to resume")
 	}
 	return nil
 }
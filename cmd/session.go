@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// createSession creates an aws session for one side of the replay (s3 or
+// kinesis) using its optional named profile, assuming its optional role with
+// credentials that are refreshed before they expire
+func createSession(log logrus.FieldLogger, side string) *session.Session {
+	opts := session.Options{
+		Profile:           viper.GetString(side + ".profile"),
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	// trust a custom CA bundle, e.g. for on-prem s3 compatible stores
+	if bundle := viper.GetString(side + ".ca_bundle"); bundle != "" {
+		f, err := os.Open(bundle)
+		if err != nil {
+			log.WithError(err).WithField("side", side).Fatalln("error opening ca bundle")
+		}
+		defer f.Close()
+		opts.CustomCABundle = f
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		log.WithError(err).WithField("side", side).Fatalln("error creating aws session")
+	}
+	roleARN := viper.GetString(side + ".role_arn")
+	if roleARN == "" {
+		return sess
+	}
+	creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID := viper.GetString(side + ".external_id"); externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+		if name := viper.GetString(side + ".role_session_name"); name != "" {
+			p.RoleSessionName = name
+		}
+		if duration := viper.GetDuration(side + ".role_duration"); duration != time.Duration(0) {
+			p.Duration = duration
+		}
+		// refresh credentials shortly before they expire
+		p.ExpiryWindow = p.Duration / 10
+	})
+	log.WithFields(logrus.Fields{
+		"role": roleARN,
+		"side": side,
+	}).Infoln("assuming role")
+	return sess.Copy(&aws.Config{Credentials: creds})
+}
@@ -0,0 +1,192 @@
+// Package csv implements a parser for csv serialized records
+package csv
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/validate"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/sirupsen/logrus"
+)
+
+// Parser implements a parser that emits each row of a csv object as a record
+type Parser struct {
+	// The number of workers to spawn
+	concurrency int
+	// Whether the first row of each object is a header
+	header bool
+	// A logger instance
+	log logrus.FieldLogger
+	// The name of the partition key column if objects have a header,
+	// otherwise its zero-based index
+	partitionKey string
+	// The percentage of partition keys to replay
+	samplePercent float64
+	// An optional tracker to notify of emitted records
+	tracker replay.Tracker
+	// A wait group to synchronise parser workers
+	wg *sync.WaitGroup
+}
+
+// NewParser returns a new csv parser
+func NewParser(c *ParserConfig) (*Parser, error) {
+	// validate config
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Header {
+		if i, err := strconv.Atoi(c.PartitionKey); err != nil || i < 0 {
+			return nil, errors.New("partition key must be a column index without a header: " + c.PartitionKey)
+		}
+	}
+	p := &Parser{
+		concurrency:   c.Concurrency,
+		header:        c.Header,
+		log:           c.Log,
+		partitionKey:  c.PartitionKey,
+		samplePercent: c.SamplePercent,
+		tracker:       c.Tracker,
+		wg:            &sync.WaitGroup{},
+	}
+	return p, nil
+}
+
+// Parse spawns a pool of workers that split the incoming stream of objects
+// into rows, publishing each to the entries stream. Parse blocks until all
+// objects have been parsed and emitted.
+func (p *Parser) Parse(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for i := 0; i < p.concurrency; i++ {
+		p.wg.Add(1)
+		go p.worker(p.wg, objects, entries)
+	}
+	p.wg.Wait()
+	close(entries)
+}
+
+// worker parses objects until the objects stream is closed
+func (p *Parser) worker(wg *sync.WaitGroup, objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for o := range objects {
+		log := p.log.WithField("key", *o.Object.Key)
+		err := p.parse(o, entries)
+		o.Body.Close()
+		if err != nil {
+			log.WithError(err).Errorln("error reading object")
+			if o.Fail != nil {
+				o.Fail(err)
+			}
+			continue
+		}
+		if p.tracker != nil {
+			p.tracker.Parsed(o.Source, *o.Object.Key)
+		}
+	}
+	wg.Done()
+}
+
+// parse reads an object's rows, emitting the original bytes of each row that
+// has a partition key
+func (p *Parser) parse(o *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) error {
+	log := p.log.WithField("key", *o.Object.Key)
+	body := &recorder{Reader: o.Body}
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	column, _ := strconv.Atoi(p.partitionKey)
+	if p.header {
+		columns, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		column = -1
+		for i, name := range columns {
+			if name == p.partitionKey {
+				column = i
+			}
+		}
+		if column == -1 {
+			return errors.New("header has no partition key column: " + p.partitionKey)
+		}
+	}
+	for {
+		start := r.InputOffset()
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := body.take(start, r.InputOffset())
+		if column >= len(row) || row[column] == "" {
+			log.Warnln("missing parition key")
+			continue
+		}
+		// skip rows whose partition key is not sampled
+		if !replay.Sampled(row[column], p.samplePercent) {
+			continue
+		}
+		// emit the row as read, without any preceding empty lines or its
+		// line ending
+		partitionKey := row[column]
+		entry := &kinesis.PutRecordsRequestEntry{
+			PartitionKey: &partitionKey,
+			Data:         bytes.TrimRight(bytes.TrimLeft(data, "\r\n"), "\r\n"),
+		}
+		if p.tracker != nil {
+			p.tracker.Record(o.Source, *o.Object.Key, entry)
+		}
+		entries <- entry
+	}
+}
+
+// recorder keeps the bytes read from a reader until they are taken
+type recorder struct {
+	io.Reader
+	// The bytes read since the last take
+	buf []byte
+	// The offset of the first byte in buf
+	offset int64
+}
+
+// Read reads from the underlying reader, keeping the bytes read
+func (r *recorder) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.buf = append(r.buf, b[:n]...)
+	return n, err
+}
+
+// take returns a copy of the bytes read between two offsets, discarding
+// those before the end offset
+func (r *recorder) take(start, end int64) []byte {
+	data := append([]byte{}, r.buf[start-r.offset:end-r.offset]...)
+	r.buf = r.buf[end-r.offset:]
+	r.offset = end
+	return data
+}
+
+// ParserConfig defines a csv parser's configuration
+type ParserConfig struct {
+	Concurrency   int                `validate:"required,min=1"`
+	Header        bool               `validate:"-"`
+	Log           logrus.FieldLogger `validate:"required"`
+	PartitionKey  string             `validate:"required"`
+	SamplePercent float64            `validate:"min=0,max=100"`
+	Tracker       replay.Tracker     `validate:"-"`
+}
+
+// NewParserConfig returns a new config value with appropriate defaults
+func NewParserConfig() *ParserConfig {
+	return &ParserConfig{
+		Concurrency: 1,
+		Log:         logrus.WithField("package", "csv"),
+	}
+}
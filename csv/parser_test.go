@@ -0,0 +1,62 @@
+package csv
+
+import (
+	"io/ioutil"
+	"s3-kinesis-replay/replay"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		header        bool
+		input         string
+		partitionKey  string
+		samplePercent float64
+		records       []string
+		keys          []string
+	}{
+		{true, "name,id\n\"a,b\",1\nc,\nd,2\n", "id", 0, []string{`"a,b",1`, "d,2"}, []string{"1", "2"}},
+		{false, "\"a,b\",1\nc\nd,2", "1", 0, []string{`"a,b",1`, "d,2"}, []string{"1", "2"}},
+		// rows are emitted with their original quoting, but without empty
+		// lines or line endings
+		{false, "\"a\",\"1\"\r\n\r\n\"b\r\nc\", 2\r\n", "1", 0, []string{`"a","1"`, "\"b\r\nc\", 2"}, []string{"1", " 2"}},
+		// only rows whose partition key is sampled are emitted
+		{false, "\"a,b\",1\nd,2", "1", 50, []string{`"a,b",1`}, []string{"1"}},
+	} {
+		config := NewParserConfig()
+		config.Header = tc.header
+		config.PartitionKey = tc.partitionKey
+		config.SamplePercent = tc.samplePercent
+		parser, err := NewParser(config)
+		assert.Nil(t, err)
+
+		objects := make(chan *replay.Object, 1)
+		objects <- &replay.Object{
+			Body:   ioutil.NopCloser(strings.NewReader(tc.input)),
+			Object: &s3.Object{Key: aws.String("foo.csv")},
+		}
+		close(objects)
+		entries := make(chan *kinesis.PutRecordsRequestEntry)
+		go parser.Parse(objects, entries)
+		records := []string{}
+		keys := []string{}
+		for e := range entries {
+			records = append(records, string(e.Data))
+			keys = append(keys, *e.PartitionKey)
+		}
+		assert.Equal(t, tc.records, records)
+		assert.Equal(t, tc.keys, keys)
+	}
+
+	// a partition key must be a column index without a header
+	config := NewParserConfig()
+	config.PartitionKey = "id"
+	_, err := NewParser(config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,212 @@
+// Package decompress implements detection and decompression of compressed
+// archive objects
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Format identifies an archive object compression format
+type Format string
+
+// supported compression formats
+const (
+	// Auto detects the format from the content encoding, magic bytes, or
+	// key extension
+	Auto Format = "auto"
+	// None disables decompression
+	None Format = "none"
+	// Bzip2 is the bzip2 format
+	Bzip2 Format = "bzip2"
+	// Gzip is the gzip format, including concatenated gzip members
+	Gzip Format = "gzip"
+	// HadoopSnappy is the hadoop snappy block format
+	HadoopSnappy Format = "hadoop-snappy"
+	// Snappy is the snappy framing format
+	Snappy Format = "snappy"
+	// Zlib is the zlib format
+	Zlib Format = "zlib"
+	// Zstd is the zstandard format
+	Zstd Format = "zstd"
+)
+
+// MagicLength is the number of leading bytes required by Detect to identify
+// a format by its magic bytes
+const MagicLength = 10
+
+// Valid returns true if the format is supported
+func (f Format) Valid() bool {
+	switch f {
+	case Auto, None, Bzip2, Gzip, HadoopSnappy, Snappy, Zlib, Zstd:
+		return true
+	}
+	return false
+}
+
+// encodings maps content encoding header values to formats
+var encodings = map[string]Format{
+	"application/zlib": Zlib,
+	"bzip2":            Bzip2,
+	"deflate":          Zlib,
+	"gzip":             Gzip,
+	"hadoop-snappy":    HadoopSnappy,
+	"snappy":           Snappy,
+	"x-bzip2":          Bzip2,
+	"x-deflate":        Zlib,
+	"x-gzip":           Gzip,
+	"x-hadoop-snappy":  HadoopSnappy,
+	"x-snappy-framed":  Snappy,
+	"x-zstd":           Zstd,
+	"zstd":             Zstd,
+}
+
+// extensions maps key extensions to formats, snappy extensions are treated
+// as the hadoop block format unless the framing format magic bytes are found
+var extensions = map[string]Format{
+	".bz2":     Bzip2,
+	".deflate": Zlib,
+	".gz":      Gzip,
+	".gzip":    Gzip,
+	".snappy":  HadoopSnappy,
+	".sz":      Snappy,
+	".zlib":    Zlib,
+	".zst":     Zstd,
+	".zstd":    Zstd,
+	".zz":      Zlib,
+}
+
+// snappyMagic is the snappy framing format stream identifier chunk
+var snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// Detect determines the compression format of an object using its content
+// encoding, leading bytes, and key, in that order of precedence
+func Detect(encoding, key string, head []byte) Format {
+	if f, ok := encodings[strings.ToLower(strings.TrimSpace(encoding))]; ok {
+		return f
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return Gzip
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case bytes.HasPrefix(head, snappyMagic):
+		return Snappy
+	case len(head) >= 4 && bytes.HasPrefix(head, []byte("BZh")) && head[3] >= '1' && head[3] <= '9':
+		return Bzip2
+	case len(head) >= 2 && head[0] == 0x78 && head[1]&0x20 == 0 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0:
+		// deflate with a 32k window, no preset dictionary, and a valid header checksum
+		return Zlib
+	}
+	if f, ok := extensions[strings.ToLower(path.Ext(key))]; ok {
+		return f
+	}
+	return None
+}
+
+// Open returns a reader that decompresses r using the given format, detecting
+// the format from the content encoding, leading bytes and key if the format is
+// Auto, along with the format used. Closing the reader does not close r
+func Open(f Format, encoding, key string, r io.Reader) (io.ReadCloser, Format, error) {
+	buffered := bufio.NewReader(r)
+	if f == Auto || f == "" {
+		head, err := buffered.Peek(MagicLength)
+		if err != nil && err != io.EOF {
+			return nil, f, err
+		}
+		f = Detect(encoding, key, head)
+	}
+	d, err := NewReader(f, buffered)
+	if err != nil {
+		return nil, f, err
+	}
+	return d, f, nil
+}
+
+// NewReader returns a reader that decompresses r using the given format
+func NewReader(f Format, r io.Reader) (io.ReadCloser, error) {
+	switch f {
+	case None:
+		return ioutil.NopCloser(r), nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case HadoopSnappy:
+		return ioutil.NopCloser(&hadoopSnappyReader{r: r}), nil
+	case Snappy:
+		return ioutil.NopCloser(snappy.NewReader(r)), nil
+	case Zlib:
+		return zlib.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, errors.New("unsupported compression format: " + string(f))
+}
+
+// hadoopSnappyReader decodes the hadoop snappy block format, where each block
+// consists of a big endian uncompressed length followed by one or more
+// length prefixed raw snappy chunks
+type hadoopSnappyReader struct {
+	buf []byte
+	r   io.Reader
+}
+
+// Read implements io.Reader
+func (h *hadoopSnappyReader) Read(p []byte) (int, error) {
+	for len(h.buf) == 0 {
+		if err := h.block(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, h.buf)
+	h.buf = h.buf[n:]
+	return n, nil
+}
+
+// block decodes the next block into the read buffer
+func (h *hadoopSnappyReader) block() error {
+	var header [4]byte
+	if _, err := io.ReadFull(h.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errors.New("hadoop-snappy: truncated block header")
+		}
+		return err
+	}
+	remaining := int(binary.BigEndian.Uint32(header[:]))
+	for remaining > 0 {
+		if _, err := io.ReadFull(h.r, header[:]); err != nil {
+			return errors.New("hadoop-snappy: truncated chunk header")
+		}
+		chunk := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(h.r, chunk); err != nil {
+			return errors.New("hadoop-snappy: truncated chunk")
+		}
+		decoded, err := snappy.Decode(nil, chunk)
+		if err != nil {
+			return err
+		}
+		if len(decoded) > remaining {
+			return errors.New("hadoop-snappy: chunk exceeds block length")
+		}
+		h.buf = append(h.buf, decoded...)
+		remaining -= len(decoded)
+	}
+	return nil
+}
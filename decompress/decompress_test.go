@@ -0,0 +1,63 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetect(t *testing.T) {
+	testcases := []*struct {
+		encoding string
+		key      string
+		head     []byte
+		expected Format
+	}{
+		{"gzip", "foo", []byte("{}"), Gzip},
+		{"", "foo", []byte{0x1f, 0x8b, 0x08}, Gzip},
+		{"", "foo", []byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+		{"", "foo", snappyMagic, Snappy},
+		{"", "foo", []byte("BZh9"), Bzip2},
+		{"", "foo", []byte{0x78, 0x9c}, Zlib},
+		{"", "foo.snappy", []byte{0x00, 0x00}, HadoopSnappy},
+		{"", "foo.snappy", snappyMagic, Snappy},
+		{"", "foo", []byte(`{"foo":"bar"}`), None},
+	}
+	for _, testcase := range testcases {
+		assert.Equal(t, testcase.expected, Detect(testcase.encoding, testcase.key, testcase.head))
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	record := []byte(`{"foo":"bar"}`)
+
+	// concatenated gzip members
+	gz := &bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		w := gzip.NewWriter(gz)
+		w.Write(record)
+		w.Close()
+	}
+
+	// hadoop snappy block containing two chunks
+	hs := &bytes.Buffer{}
+	binary.Write(hs, binary.BigEndian, uint32(len(record)*2))
+	for i := 0; i < 2; i++ {
+		chunk := snappy.Encode(nil, record)
+		binary.Write(hs, binary.BigEndian, uint32(len(chunk)))
+		hs.Write(chunk)
+	}
+
+	for f, data := range map[Format][]byte{Gzip: gz.Bytes(), HadoopSnappy: hs.Bytes()} {
+		r, err := NewReader(f, bytes.NewReader(data))
+		assert.Nil(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, append(record, record...), b)
+	}
+}
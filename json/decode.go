@@ -0,0 +1,169 @@
+package json
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	// FramingRegexp splits objects into records using the configured replace
+	// and delimiter patterns
+	FramingRegexp = "regexp"
+	// FramingDecoder splits objects into records by tokenizing the json
+	// values they contain
+	FramingDecoder = "decoder"
+)
+
+// errTruncated is reported for a record that is still open at the end of an
+// object
+var errTruncated = errors.New("unexpected end of object")
+
+// scanner buffers a stream so that each value can be decoded from its first
+// byte, tracking the offset in the stream of the first buffered byte
+type scanner struct {
+	buf    []byte
+	err    error
+	offset int64
+	pos    int
+	r      io.Reader
+	size   int
+}
+
+// fill reads more of the stream into the buffer
+func (s *scanner) fill() error {
+	for s.err == nil {
+		if cap(s.buf)-len(s.buf) < s.size {
+			buf := make([]byte, len(s.buf), 2*len(s.buf)+s.size)
+			copy(buf, s.buf)
+			s.buf = buf
+		}
+		n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+n]
+		s.err = err
+		if n > 0 {
+			return nil
+		}
+	}
+	return s.err
+}
+
+// peek returns the next byte of the stream without consuming it
+func (s *scanner) peek() (byte, error) {
+	if len(s.buf) == 0 {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return s.buf[0], nil
+}
+
+// skip consumes the next n bytes of the stream
+func (s *scanner) skip(n int) {
+	s.buf = s.buf[n:]
+	s.offset += int64(n)
+}
+
+// Read reads the buffered stream from the position of the last rewind,
+// without consuming it
+func (s *scanner) Read(p []byte) (int, error) {
+	if s.pos == len(s.buf) {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+// rewind resets Read to the next unconsumed byte of the stream
+func (s *scanner) rewind() {
+	s.pos = 0
+}
+
+// decode reads a stream of json values, emitting the exact bytes of each
+// value as a record. Values may be concatenated, separated by whitespace
+// (e.g. NDJSON) or commas, or wrapped in a top-level array whose elements are
+// each emitted as a record. Values that are not valid json are reported to
+// malformed along with the offset in the stream of the offending byte, and
+// framing resumes at the next object after it, so that an object left open
+// does not swallow the records that follow it.
+func (p *Parser) decode(r io.Reader, emit func([]byte) error, malformed func(int64, error)) error {
+	s := &scanner{r: r, size: p.bufferSize}
+	array := int64(-1)
+	resync := false
+	var value json.RawMessage
+	for {
+		c, err := s.peek()
+		if err == io.EOF {
+			if array >= 0 && !resync {
+				malformed(array, errTruncated)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start := s.offset
+		switch {
+		case isSpace(c) || c == ',':
+			s.skip(1)
+			continue
+		case c == '[' && array < 0:
+			array = start
+			s.skip(1)
+			continue
+		case c == ']' && array >= 0:
+			array = -1
+			s.skip(1)
+			continue
+		case resync && c != '{':
+			// skip the remainder of a malformed value
+			s.skip(1)
+			continue
+		}
+
+		s.rewind()
+		dec := json.NewDecoder(s)
+		err = dec.Decode(&value)
+		if serr, ok := err.(*json.SyntaxError); ok {
+			// resume at the offending byte, which may begin the next record
+			// if the value was left open, reporting only the first error of
+			// a run of malformed bytes
+			n := 0
+			if serr.Offset > 1 {
+				n = int(serr.Offset - 1)
+			}
+			if !resync {
+				malformed(start+int64(n), err)
+			}
+			if n == 0 {
+				n = 1
+			}
+			s.skip(n)
+			resync = true
+			continue
+		}
+		if err == io.ErrUnexpectedEOF {
+			malformed(start, errTruncated)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		n := int(dec.InputOffset())
+		record := append([]byte(nil), s.buf[:n]...)
+		s.skip(n)
+		resync = false
+		if err := emit(record); err != nil {
+			return err
+		}
+	}
+}
+
+// isSpace determines whether a byte is json whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
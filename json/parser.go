@@ -2,9 +2,17 @@
 package json
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"regexp"
+	"s3-kinesis-replay/kpl"
 	"s3-kinesis-replay/replay"
 	"s3-kinesis-replay/validate"
+	"strings"
 	"sync"
 
 	"github.com/Jeffail/gabs"
@@ -15,20 +23,35 @@ import (
 
 // Parser implements a parser for json serialized records
 type Parser struct {
+	// The minimum number of bytes to read from an object stream at a time
+	bufferSize int
 	// The number of workers to spawn
 	concurrency int
+	// Whether to expand kpl aggregated records into their user records
+	deaggregate bool
 	// The delimiter to use for splitting record batches
 	delimiter *regexp.Regexp
+	// How objects are split into records
+	framing string
 	// A logger instance
 	log logrus.FieldLogger
+	// Whether to emit records in object order
+	ordered bool
 	// The json path to the partition key field
 	partitionKey string
+	// An optional percentage of partition keys whose records are emitted
+	samplePercent float64
+	// An optional dot separated path to an array of records within each
+	// envelope
+	recordsPath string
 	// An optional pattern to replace before splitting
 	replace *regexp.Regexp
 	// An optional string to use as a replacement
 	replaceWith string
 	// The reference path for the record's json schema
 	schema *gojsonschema.Schema
+	// An optional tracker to notify of emitted records
+	tracker replay.Tracker
 	// A wait group to synchronise parser workers
 	wg *sync.WaitGroup
 }
@@ -40,14 +63,25 @@ func NewParser(c *ParserConfig) (*Parser, error) {
 	if err != nil {
 		return nil, err
 	}
-	// generate json schema
+	switch c.Framing {
+	case FramingRegexp, FramingDecoder:
+	default:
+		return nil, errors.New("invalid framing: " + c.Framing)
+	}
 
 	// create new parser
 	p := &Parser{
-		concurrency:  c.Concurrency,
-		log:          c.Log,
-		partitionKey: c.PartitionKey,
-		wg:           &sync.WaitGroup{},
+		bufferSize:    c.BufferSize,
+		concurrency:   c.Concurrency,
+		deaggregate:   c.Deaggregate,
+		framing:       c.Framing,
+		log:           c.Log,
+		ordered:       c.Ordered,
+		partitionKey:  c.PartitionKey,
+		recordsPath:   c.RecordsPath,
+		samplePercent: c.SamplePercent,
+		tracker:       c.Tracker,
+		wg:            &sync.WaitGroup{},
 	}
 	// add json schema if included
 	if c.Schema != "" {
@@ -73,6 +107,10 @@ func NewParser(c *ParserConfig) (*Parser, error) {
 // parsing and filtering logic before publishing to the entries stream. Parse blocks until
 // all objects have been parsed and emitted.
 func (p *Parser) Parse(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	if p.ordered {
+		p.parseOrdered(objects, entries)
+		return
+	}
 	for i := 0; i < p.concurrency; i++ {
 		p.wg.Add(1)
 		go p.worker(p.wg, objects, entries)
@@ -81,83 +119,325 @@ func (p *Parser) Parse(objects chan *replay.Object, entries chan *kinesis.PutRec
 	close(entries)
 }
 
+// parseOrdered parses objects concurrently while emitting their records in
+// object order. Each object's records are buffered until all records of the
+// objects before it have been emitted, with at most concurrency objects
+// parsed ahead of the object currently being emitted.
+func (p *Parser) parseOrdered(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	jobs := make(chan *job)
+	for i := 0; i < p.concurrency; i++ {
+		p.wg.Add(1)
+		go p.orderedWorker(p.wg, jobs)
+	}
+	// forward the records of each object in the order objects were received
+	ordered := make(chan chan *kinesis.PutRecordsRequestEntry, p.concurrency)
+	done := make(chan struct{})
+	go func() {
+		for records := range ordered {
+			for e := range records {
+				entries <- e
+			}
+		}
+		close(done)
+	}()
+	for o := range objects {
+		records := make(chan *kinesis.PutRecordsRequestEntry, orderedBufferSize)
+		ordered <- records
+		jobs <- &job{entries: records, object: o}
+	}
+	close(jobs)
+	close(ordered)
+	p.wg.Wait()
+	<-done
+	close(entries)
+}
+
+// orderedBufferSize is the number of records buffered for each object that
+// is parsed ahead of the object currently being emitted in ordered mode
+const orderedBufferSize = 1000
+
+// job describes an object to parse in ordered mode, and the stream of its
+// records
+type job struct {
+	entries chan *kinesis.PutRecordsRequestEntry
+	object  *replay.Object
+}
+
 // worker creates a new worker that performs the actual parsing/filtering
 // the configured delimiter, filtering invalid records using the defined jsons chema
 func (p *Parser) worker(wg *sync.WaitGroup, objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
 	for o := range objects {
-		log := p.log.WithField("key", *o.Object.Key)
-		buff := o.Data
+		p.parse(o, entries)
+	}
+	wg.Done()
+}
 
-		// apply replacements
-		if p.replace != nil {
-			buff = p.replace.ReplaceAll(buff, []byte(p.replaceWith))
-		}
+// orderedWorker parses objects in ordered mode, closing each object's stream
+// of records once it has been parsed
+func (p *Parser) orderedWorker(wg *sync.WaitGroup, jobs chan *job) {
+	for j := range jobs {
+		p.parse(j.object, j.entries)
+		close(j.entries)
+	}
+	wg.Done()
+}
 
-		// build record set using delimiter if provided
-		records := []string{}
-		if p.delimiter != nil {
-			records = p.delimiter.Split(string(buff), -1)
-		} else {
-			records = append(records, string(buff))
-		}
-
-		// parse the necessary parts of each record and filter out invalid records
-		for _, raw := range records {
-			// validate record against schema if defined
-			if p.schema != nil {
-				record := gojsonschema.NewStringLoader(raw)
-				result, err := p.schema.Validate(record)
-				if err != nil {
-					log.WithError(err).Warnln("skipping record with validation error")
-					continue
-				} else if !result.Valid() {
-					log.WithField("details", result.Errors()).Warnln("skipping invalid record")
-					continue
-				}
+// parse splits a single object into records, emitting those that are valid
+// on the entries stream
+func (p *Parser) parse(o *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	log := p.log.WithField("key", *o.Object.Key)
+
+	// validate record against schema if defined
+	valid := func(b []byte) bool {
+		if p.schema != nil {
+			record := gojsonschema.NewStringLoader(string(b))
+			result, err := p.schema.Validate(record)
+			if err != nil {
+				log.WithError(err).Warnln("skipping record with validation error")
+				return false
+			} else if !result.Valid() {
+				log.WithField("details", result.Errors()).Warnln("skipping invalid record")
+				return false
 			}
+		}
+		return true
+	}
+
+	// commit a sampled record to the entries stream
+	send := func(entry *kinesis.PutRecordsRequestEntry) {
+		// skip records whose partition key is not sampled
+		if !replay.Sampled(*entry.PartitionKey, p.samplePercent) {
+			return
+		}
+		if p.tracker != nil {
+			p.tracker.Record(o.Source, *o.Object.Key, entry)
+		}
+		entries <- entry
+	}
 
-			// parse record
-			b := []byte(raw)
-			parsed, err := gabs.ParseJSON(b)
+	// parse the necessary parts of each record and filter out invalid records,
+	// falling back to the record's envelope for the partition key if any
+	record := func(b []byte, envelope *gabs.Container) {
+		if !valid(b) {
+			return
+		}
+
+		// parse record
+		parsed, err := gabs.ParseJSON(b)
+		if err != nil {
+			log.WithError(err).Warnln("unable to parse record")
+			return
+		}
+
+		// extract parition key using path
+		key := parsed.Path(p.partitionKey)
+		if key.Data() == nil && envelope != nil {
+			key = envelope.Path(p.partitionKey)
+		}
+		partitionKey := key.String()
+		if partitionKey == "" {
+			log.Warnln("missing parition key")
+			return
+		}
+
+		// build kinesis record and commit to entries stream
+		send(&kinesis.PutRecordsRequestEntry{
+			PartitionKey: &partitionKey,
+			Data:         b,
+		})
+	}
+
+	// expand kpl aggregated records into user records that keep their own
+	// partition and explicit hash keys, failing the object if an aggregated
+	// record is corrupt, and fan each element of an envelope's records out as
+	// its own record
+	emit := func(b []byte) error {
+		if p.deaggregate && kpl.Aggregated(b) {
+			users, err := kpl.Deaggregate(b)
 			if err != nil {
-				log.WithError(err).Warnln("unable to parse record")
-				continue
+				return err
 			}
+			for _, entry := range users {
+				if valid(entry.Data) {
+					send(entry)
+				}
+			}
+			return nil
+		}
+		if p.recordsPath == "" {
+			record(b, nil)
+			return nil
+		}
+		envelope, err := gabs.ParseJSON(b)
+		if err != nil {
+			log.WithError(err).Warnln("unable to parse envelope")
+			return nil
+		}
+		elements, err := p.records(b)
+		if err != nil {
+			log.WithError(err).Warnln("unable to extract envelope records")
+			return nil
+		}
+		for _, element := range elements {
+			record(element, envelope)
+		}
+		return nil
+	}
 
-			// extract parition key using path
-			partitionKey := parsed.Path(p.partitionKey).String()
-			if partitionKey == "" {
-				log.Warnln("missing parition key")
-				continue
+	// objects of consecutive aggregated records, such as firehose deliveries
+	// of a stream's records, are read one aggregated record at a time rather
+	// than framed, since their binary data may contain delimiters. A corrupt
+	// aggregated record fails the object.
+	var body io.Reader = o.Body
+	aggregated := false
+	if p.deaggregate {
+		br := bufio.NewReader(o.Body)
+		magic, _ := br.Peek(len(kpl.Magic))
+		aggregated = bytes.Equal(magic, kpl.Magic)
+		body = br
+	}
+	var err error
+	switch {
+	case aggregated:
+		r := kpl.NewReader(body)
+		for {
+			var b []byte
+			if b, err = r.Next(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				break
+			}
+			if err = emit(b); err != nil {
+				break
 			}
+		}
+	case p.framing == FramingDecoder:
+		err = p.decode(body, emit, func(offset int64, err error) {
+			log.WithError(err).WithField("offset", offset).Warnln("skipping malformed record")
+		})
+	default:
+		err = p.split(body, emit)
+	}
+	o.Body.Close()
+	if err != nil {
+		log.WithError(err).Errorln("error reading object")
+		if o.Fail != nil {
+			o.Fail(err)
+		}
+		return
+	}
 
-			// build kinesis record and commit to entries stream
-			entry := &kinesis.PutRecordsRequestEntry{
-				PartitionKey: &partitionKey,
-				Data:         b,
+	if p.tracker != nil {
+		p.tracker.Parsed(o.Source, *o.Object.Key)
+	}
+}
+
+// records returns the exact bytes of each element of the array at the
+// records path of an envelope
+func (p *Parser) records(b []byte) ([]json.RawMessage, error) {
+	raw := json.RawMessage(b)
+	for _, name := range strings.Split(p.recordsPath, ".") {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if raw, ok = fields[name]; !ok {
+			return nil, errors.New("missing records path: " + p.recordsPath)
+		}
+	}
+	elements := []json.RawMessage{}
+	if err := json.Unmarshal(raw, &elements); err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// split reads an object stream incrementally, applying the configured
+// replacement and delimiter to the buffered data and emitting each record
+// as soon as the delimiter following it has been read. Only the incomplete
+// trailing record is retained between reads, and it is reprocessed along
+// with the next read, so the replacement should not itself match the
+// replace pattern.
+func (p *Parser) split(r io.Reader, emit func([]byte) error) error {
+	// without a delimiter, each object is a single record
+	if p.delimiter == nil {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if p.replace != nil {
+			b = p.replace.ReplaceAll(b, []byte(p.replaceWith))
+		}
+		return emit(b)
+	}
+
+	buff := []byte{}
+	for {
+		// read at least as much as is already buffered to amortize the cost
+		// of reprocessing large incomplete records
+		size := p.bufferSize
+		if len(buff) > size {
+			size = len(buff)
+		}
+		chunk := make([]byte, size)
+		n, err := io.ReadFull(r, chunk)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+		buff = append(buff, chunk[:n]...)
+
+		// apply replacements
+		if p.replace != nil {
+			buff = p.replace.ReplaceAll(buff, []byte(p.replaceWith))
+		}
+
+		// emit complete records, ignoring delimiters at the end of the buffer
+		// that could continue into the next read
+		start := 0
+		for _, m := range p.delimiter.FindAllIndex(buff, -1) {
+			if !eof && m[1] >= len(buff) {
+				break
+			}
+			if err := emit(append([]byte{}, buff[start:m[0]]...)); err != nil {
+				return err
 			}
-			entries <- entry
+			start = m[1]
 		}
+		if eof {
+			return emit(append([]byte{}, buff[start:]...))
+		}
+		buff = append([]byte{}, buff[start:]...)
 	}
-	wg.Done()
 }
 
 // ParserConfig defines a json parser's configuration
 type ParserConfig struct {
-	Concurrency  int                `validate:"required,min=1"`
-	Delimiter    *regexp.Regexp     `validate:"-"`
-	Log          logrus.FieldLogger `validate:"required"`
-	PartitionKey string             `validate:"required"`
-	Replace      *regexp.Regexp     `validate:"-"`
-	ReplaceWith  string             `validate:"-"`
-	Schema       string             `validate:"-"`
+	BufferSize    int                `validate:"required,min=1"`
+	Concurrency   int                `validate:"required,min=1"`
+	Deaggregate   bool               `validate:"-"`
+	Delimiter     *regexp.Regexp     `validate:"-"`
+	Framing       string             `validate:"required"`
+	Log           logrus.FieldLogger `validate:"required"`
+	Ordered       bool               `validate:"-"`
+	PartitionKey  string             `validate:"required"`
+	RecordsPath   string             `validate:"-"`
+	Replace       *regexp.Regexp     `validate:"-"`
+	ReplaceWith   string             `validate:"-"`
+	SamplePercent float64            `validate:"min=0,max=100"`
+	Schema        string             `validate:"-"`
+	Tracker       replay.Tracker     `validate:"-"`
 }
 
 // NewParserConfig returns a new config value with appropriate defaults
 func NewParserConfig() *ParserConfig {
 	return &ParserConfig{
+		BufferSize:  64 * 1024,
 		Concurrency: 1,
 		Delimiter:   regexp.MustCompile("},{"),
+		Framing:     FramingRegexp,
 		Log:         logrus.WithField("package", "json"),
 		Replace:     regexp.MustCompile("}[\r\n]*{"),
 		ReplaceWith: "}},{{",
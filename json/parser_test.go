@@ -0,0 +1,265 @@
+package json
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"s3-kinesis-replay/kpl"
+	"s3-kinesis-replay/replay"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAcrossReads(t *testing.T) {
+	input := "{\"a\":1}\r\n{\"b\":2}{\"c\":3}\n\n{\"d\":4}"
+	results := [][]string{}
+	for _, size := range []int{1, 3, len(input)} {
+		// create parser with a buffer small enough for delimiters to span reads
+		config := NewParserConfig()
+		config.BufferSize = size
+		config.PartitionKey = "foo"
+		parser, err := NewParser(config)
+		assert.Nil(t, err)
+
+		records := []string{}
+		err = parser.split(strings.NewReader(input), func(b []byte) error {
+			records = append(records, string(b))
+			return nil
+		})
+		assert.Nil(t, err)
+		results = append(results, records)
+	}
+	assert.Equal(t, []string{`{"a":1}`, `{"b":2}`, `{"c":3}`, `{"d":4}`}, results[2])
+	assert.Equal(t, results[2], results[0])
+	assert.Equal(t, results[2], results[1])
+}
+
+func TestReadFailed(t *testing.T) {
+	config := NewParserConfig()
+	config.PartitionKey = "id"
+	parser, err := NewParser(config)
+	assert.Nil(t, err)
+
+	// an object whose body fails partway through is failed rather than parsed
+	var failed error
+	objects := make(chan *replay.Object, 1)
+	objects <- &replay.Object{
+		Body: ioutil.NopCloser(io.MultiReader(
+			strings.NewReader(`{"id":"a"}`+"\n"),
+			&failingReader{err: errors.New("connection reset")},
+		)),
+		Fail: func(err error) {
+			failed = err
+		},
+		Object: &s3.Object{Key: aws.String("foo")},
+	}
+	close(objects)
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	go parser.Parse(objects, entries)
+	for range entries {
+	}
+	assert.EqualError(t, failed, "connection reset")
+}
+
+// failingReader fails every read, as a body whose connection is reset would
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestParseOrdered(t *testing.T) {
+	config := NewParserConfig()
+	config.Concurrency = 4
+	config.Ordered = true
+	config.PartitionKey = "id"
+	parser, err := NewParser(config)
+	assert.Nil(t, err)
+
+	// emit objects whose sizes decrease, so that later objects finish parsing
+	// first
+	objects := make(chan *replay.Object, 8)
+	expected := []string{}
+	for i := 0; i < 8; i++ {
+		records := []string{}
+		for j := 0; j < (8-i)*500; j++ {
+			record := fmt.Sprintf(`{"id":"%d-%d"}`, i, j)
+			records = append(records, record)
+			expected = append(expected, record)
+		}
+		objects <- &replay.Object{
+			Body:   ioutil.NopCloser(strings.NewReader(strings.Join(records, "\n"))),
+			Object: &s3.Object{Key: aws.String(fmt.Sprintf("%d", i))},
+		}
+	}
+	close(objects)
+
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	go parser.Parse(objects, entries)
+	records := []string{}
+	for e := range entries {
+		records = append(records, string(e.Data))
+	}
+	assert.Equal(t, expected, records)
+}
+
+func TestDecode(t *testing.T) {
+	for input, expected := range map[string][]string{
+		// concatenated objects whose values contain delimiter-like strings
+		`{"a":"}{"}{"b":"},{"}`: {`{"a":"}{"}`, `{"b":"},{"}`},
+		// ndjson and pretty-printed records
+		"{\"a\":1}\n{\n  \"b\": [1, 2]\n}\n": {`{"a":1}`, "{\n  \"b\": [1, 2]\n}"},
+		// top-level arrays
+		`[{"a":"\"]"}, {"b":2}] [{"c":3}]`: {`{"a":"\"]"}`, `{"b":2}`, `{"c":3}`},
+	} {
+		for _, size := range []int{16, 64 * 1024} {
+			config := NewParserConfig()
+			config.BufferSize = size
+			config.Framing = FramingDecoder
+			config.PartitionKey = "foo"
+			parser, err := NewParser(config)
+			assert.Nil(t, err)
+
+			records := []string{}
+			err = parser.decode(strings.NewReader(input), func(b []byte) error {
+				records = append(records, string(b))
+				return nil
+			}, func(offset int64, err error) {
+				t.Errorf("unexpected malformed record at %d: %v", offset, err)
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, expected, records)
+		}
+	}
+
+	// report the offset of malformed records and resume at the next object
+	// after them
+	for _, test := range []struct {
+		input   string
+		records []string
+		offsets []int64
+	}{
+		{`{"a":1}{"b":x}{"c":3}{"d":`, []string{`{"a":1}`, `{"c":3}`}, []int64{12, 21}},
+		// objects left open do not swallow the records that follow them
+		{"{\"a\":1\n{\"b\":2}\n{\"c\":\"x\n{\"d\":4}\n", []string{`{"b":2}`, `{"d":4}`}, []int64{7, 22}},
+		{`[{"a":{"b":1}, {"c":3}]`, []string{`{"c":3}`}, []int64{15}},
+		// stray structural characters are skipped
+		{`{"a":1}} ]:{"b":2}`, []string{`{"a":1}`, `{"b":2}`}, []int64{7}},
+		{`{"a":1}}{"b":2}]`, []string{`{"a":1}`, `{"b":2}`}, []int64{7, 15}},
+	} {
+		config := NewParserConfig()
+		config.Framing = FramingDecoder
+		config.PartitionKey = "foo"
+		parser, err := NewParser(config)
+		assert.Nil(t, err)
+		records := []string{}
+		offsets := []int64{}
+		err = parser.decode(strings.NewReader(test.input), func(b []byte) error {
+			records = append(records, string(b))
+			return nil
+		}, func(offset int64, err error) {
+			offsets = append(offsets, offset)
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, test.records, records, test.input)
+		assert.Equal(t, test.offsets, offsets, test.input)
+	}
+}
+
+func TestRecordsPath(t *testing.T) {
+	config := NewParserConfig()
+	config.Framing = FramingDecoder
+	config.PartitionKey = "owner"
+	config.RecordsPath = "batch.records"
+	parser, err := NewParser(config)
+	assert.Nil(t, err)
+
+	objects := make(chan *replay.Object, 1)
+	objects <- &replay.Object{
+		Body: ioutil.NopCloser(strings.NewReader(
+			`{"owner":"a","batch":{"records":[{"id":1.0},{"owner":"b","id":12345678901234567890}]}}` + "\n" +
+				`{"owner":"c","batch":{}}`,
+		)),
+		Object: &s3.Object{Key: aws.String("foo")},
+	}
+	close(objects)
+
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	go parser.Parse(objects, entries)
+	records := []string{}
+	keys := []string{}
+	for e := range entries {
+		records = append(records, string(e.Data))
+		keys = append(keys, *e.PartitionKey)
+	}
+	// elements are emitted with their original bytes, taking the partition
+	// key from the envelope if the element has none
+	assert.Equal(t, []string{`{"id":1.0}`, `{"owner":"b","id":12345678901234567890}`}, records)
+	assert.Equal(t, []string{`"a"`, `"b"`}, keys)
+}
+
+func TestDeaggregate(t *testing.T) {
+	// aggregated records of {"id":<n>} with partition key "a" and explicit
+	// hash key "1"
+	aggregate := func(n byte) []byte {
+		message := []byte("\x0a\x01a\x12\x011\x1a\x0e\x08\x00\x10\x00\x1a\x08{\"id\":" + string(n) + "}")
+		sum := md5.Sum(message)
+		return append(append(append([]byte{}, kpl.Magic...), message...), sum[:]...)
+	}
+	aggregated := aggregate('1')
+	corrupt := aggregate('3')
+	corrupt[len(corrupt)-1] ^= 0xff
+	// a firehose delivery of consecutive aggregated records, one corrupt
+	delivery := append(append(aggregate('1'), corrupt...), aggregate('2')...)
+
+	config := NewParserConfig()
+	config.Concurrency = 1
+	config.Deaggregate = true
+	config.PartitionKey = "id"
+	parser, err := NewParser(config)
+	assert.Nil(t, err)
+
+	objects := make(chan *replay.Object, 3)
+	failed := []string{}
+	for i, data := range [][]byte{aggregated, corrupt, delivery} {
+		key := fmt.Sprintf("%d", i)
+		objects <- &replay.Object{
+			Body: ioutil.NopCloser(bytes.NewReader(data)),
+			Fail: func(err error) {
+				assert.Equal(t, kpl.ErrChecksum, err)
+				failed = append(failed, key)
+			},
+			Object: &s3.Object{Key: aws.String(key)},
+		}
+	}
+	close(objects)
+
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	go parser.Parse(objects, entries)
+	results := []*kinesis.PutRecordsRequestEntry{}
+	for e := range entries {
+		results = append(results, e)
+	}
+	// the records before a corrupt aggregated record are replayed, and its
+	// object fails
+	assert.Equal(t, []*kinesis.PutRecordsRequestEntry{{
+		Data:            []byte(`{"id":1}`),
+		ExplicitHashKey: aws.String("1"),
+		PartitionKey:    aws.String("a"),
+	}, {
+		Data:            []byte(`{"id":1}`),
+		ExplicitHashKey: aws.String("1"),
+		PartitionKey:    aws.String("a"),
+	}}, results)
+	assert.Equal(t, []string{"1", "2"}, failed)
+}
@@ -0,0 +1,183 @@
+package kinesis
+
+import (
+	"crypto/md5"
+	"math/big"
+	"s3-kinesis-replay/kpl"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// shard describes the hash key range of an open shard
+type shard struct {
+	end   *big.Int
+	start *big.Int
+}
+
+// shards returns the hash key ranges of the stream's open shards, ordered by
+// starting hash key
+func (p *Producer) shards() ([]*shard, error) {
+	shards := []*shard{}
+	params := &kinesis.DescribeStreamInput{
+		StreamName: p.streamName,
+	}
+	var perr error
+	err := p.client.DescribeStreamPages(params, func(output *kinesis.DescribeStreamOutput, more bool) bool {
+		for _, s := range output.StreamDescription.Shards {
+			// skip closed parent shards
+			if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+				continue
+			}
+			start, ok := new(big.Int).SetString(aws.StringValue(s.HashKeyRange.StartingHashKey), 10)
+			end, ok2 := new(big.Int).SetString(aws.StringValue(s.HashKeyRange.EndingHashKey), 10)
+			if !ok || !ok2 {
+				perr = errInvalidHashKey
+				return false
+			}
+			shards = append(shards, &shard{end: end, start: start})
+		}
+		return true
+	})
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].start.Cmp(shards[j].start) < 0
+	})
+	return shards, nil
+}
+
+// sameShards determines whether two lists of shards describe the same hash
+// key ranges
+func sameShards(a, b []*shard) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].start.Cmp(b[i].start) != 0 || a[i].end.Cmp(b[i].end) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashKey returns the hash key that determines an entry's shard, which is
+// either its explicit hash key or the md5 hash of its partition key
+func hashKey(entry *kinesis.PutRecordsRequestEntry) *big.Int {
+	if entry.ExplicitHashKey != nil {
+		if h, ok := new(big.Int).SetString(*entry.ExplicitHashKey, 10); ok {
+			return h
+		}
+	}
+	sum := md5.Sum([]byte(aws.StringValue(entry.PartitionKey)))
+	return new(big.Int).SetBytes(sum[:])
+}
+
+// shardOf returns the index of the shard whose range includes a hash key, or
+// -1 if no open shard does
+func shardOf(shards []*shard, h *big.Int) int {
+	i := sort.Search(len(shards), func(i int) bool {
+		return shards[i].end.Cmp(h) >= 0
+	})
+	if i == len(shards) || shards[i].start.Cmp(h) > 0 {
+		return -1
+	}
+	return i
+}
+
+// aggregate packs incoming entries bound for the same shard into kpl
+// aggregated records of up to the aggregate size, emitting them when full and
+// at least once per buffer window. Entries too large to aggregate are emitted
+// unchanged, after any pending aggregated record for their shard so that the
+// order of each shard's records is preserved. The stream's shards are
+// described again every shard refresh interval, emitting all pending
+// aggregated records if they have changed, so that records are not packed
+// for shards closed by resharding.
+func (p *Producer) aggregate(entries, aggregated chan *kinesis.PutRecordsRequestEntry) {
+	shards, err := p.shards()
+	if err != nil {
+		p.log.WithError(err).Fatalln("error describing stream shards")
+	}
+	aggregators := map[int]*kpl.Aggregator{}
+	hashKeys := map[int]*big.Int{}
+	flush := func(i int) {
+		a := aggregators[i]
+		switch a.Len() {
+		case 0:
+			return
+		case 1:
+			aggregated <- a.Entries()[0]
+		default:
+			// route the aggregated record to the shard of its first record
+			entry := a.Aggregate(aws.String(hashKeys[i].String()))
+			if p.tracker != nil {
+				p.mu.Lock()
+				p.aggregated[entry] = a.Entries()
+				p.mu.Unlock()
+			}
+			aggregated <- entry
+		}
+		aggregators[i] = kpl.NewAggregator()
+	}
+	ticker := time.NewTicker(p.bufferWindow)
+	defer ticker.Stop()
+	refresh := time.NewTicker(p.shardRefreshInterval)
+	defer refresh.Stop()
+	for {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				for i := range aggregators {
+					flush(i)
+				}
+				close(aggregated)
+				return
+			}
+			h := hashKey(e)
+			i := shardOf(shards, h)
+			a := aggregators[i]
+			if a == nil {
+				a = kpl.NewAggregator()
+				aggregators[i] = a
+			}
+			if a.Len() > 0 && a.Size(e) > p.aggregateSize {
+				flush(i)
+				a = aggregators[i]
+			}
+			if a.Size(e) > p.aggregateSize {
+				aggregated <- e
+				continue
+			}
+			if a.Len() == 0 {
+				hashKeys[i] = h
+			}
+			a.Add(e)
+		case <-ticker.C:
+			for i := range aggregators {
+				flush(i)
+			}
+		case <-refresh.C:
+			refreshed, err := p.shards()
+			if err != nil {
+				p.log.WithError(err).Warnln("error refreshing stream shards")
+				continue
+			}
+			if sameShards(shards, refreshed) {
+				continue
+			}
+			p.log.WithField("shards", len(refreshed)).Infoln("stream shards changed")
+			for i := range aggregators {
+				flush(i)
+			}
+			aggregators = map[int]*kpl.Aggregator{}
+			hashKeys = map[int]*big.Int{}
+			shards = refreshed
+		}
+	}
+}
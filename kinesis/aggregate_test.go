@@ -0,0 +1,154 @@
+package kinesis
+
+import (
+	"fmt"
+	"s3-kinesis-replay/kpl"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// shardsClient describes a stream with a closed parent shard and two open
+// children splitting the hash key space at 100
+type shardsClient struct {
+	kinesisiface.KinesisAPI
+}
+
+func (c *shardsClient) DescribeStreamPages(input *kinesis.DescribeStreamInput, fn func(*kinesis.DescribeStreamOutput, bool) bool) error {
+	shard := func(start, end string, closed bool) *kinesis.Shard {
+		s := &kinesis.Shard{
+			HashKeyRange:        &kinesis.HashKeyRange{StartingHashKey: aws.String(start), EndingHashKey: aws.String(end)},
+			SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+		}
+		if closed {
+			s.SequenceNumberRange.EndingSequenceNumber = aws.String("2")
+		}
+		return s
+	}
+	max := "340282366920938463463374607431768211455"
+	fn(&kinesis.DescribeStreamOutput{StreamDescription: &kinesis.StreamDescription{
+		Shards: []*kinesis.Shard{shard("0", max, true), shard("100", max, false), shard("0", "99", false)},
+	}}, false)
+	return nil
+}
+
+func TestAggregate(t *testing.T) {
+	config := NewProducerConfig()
+	config.AggregateSize = 100
+	config.BufferWindow = time.Hour
+	config.Client = &shardsClient{}
+	config.StreamName = "foo"
+	p, err := NewProducer(config)
+	assert.Nil(t, err)
+
+	// alternate small records between shards, followed by a record too large
+	// to aggregate
+	entries := make(chan *kinesis.PutRecordsRequestEntry, 20)
+	for i := 0; i < 10; i++ {
+		entries <- &kinesis.PutRecordsRequestEntry{
+			Data:            []byte(fmt.Sprintf("record-%d", i)),
+			ExplicitHashKey: aws.String(fmt.Sprintf("%d", 50+i%2*100)),
+			PartitionKey:    aws.String(fmt.Sprintf("%d", i)),
+		}
+	}
+	entries <- &kinesis.PutRecordsRequestEntry{
+		Data:            make([]byte, 100),
+		ExplicitHashKey: aws.String("50"),
+		PartitionKey:    aws.String("large"),
+	}
+	close(entries)
+	aggregated := make(chan *kinesis.PutRecordsRequestEntry, 20)
+	p.aggregate(entries, aggregated)
+
+	// each shard's records are written in order, within the aggregate size
+	shards := map[string][]string{}
+	for e := range aggregated {
+		assert.True(t, len(e.Data) <= 100 || *e.PartitionKey == "large")
+		records := []*kinesis.PutRecordsRequestEntry{e}
+		if kpl.Aggregated(e.Data) {
+			records, err = kpl.Deaggregate(e.Data)
+			assert.Nil(t, err)
+		}
+		for _, r := range records {
+			assert.Equal(t, *e.ExplicitHashKey == "50", *r.ExplicitHashKey == "50")
+			shards[*r.ExplicitHashKey] = append(shards[*r.ExplicitHashKey], *r.PartitionKey)
+		}
+	}
+	assert.Equal(t, []string{"0", "2", "4", "6", "8", "large"}, shards["50"])
+	assert.Equal(t, []string{"1", "3", "5", "7", "9"}, shards["150"])
+}
+
+// splitClient describes a stream with a single shard, which has been split
+// at 100 by the time the stream is described again
+type splitClient struct {
+	kinesisiface.KinesisAPI
+	calls int32
+}
+
+func (c *splitClient) DescribeStreamPages(input *kinesis.DescribeStreamInput, fn func(*kinesis.DescribeStreamOutput, bool) bool) error {
+	if atomic.AddInt32(&c.calls, 1) > 1 {
+		return (&shardsClient{}).DescribeStreamPages(input, fn)
+	}
+	fn(&kinesis.DescribeStreamOutput{StreamDescription: &kinesis.StreamDescription{
+		Shards: []*kinesis.Shard{{
+			HashKeyRange:        &kinesis.HashKeyRange{StartingHashKey: aws.String("0"), EndingHashKey: aws.String("340282366920938463463374607431768211455")},
+			SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1")},
+		}},
+	}}, false)
+	return nil
+}
+
+func TestAggregateRefresh(t *testing.T) {
+	client := &splitClient{}
+	config := NewProducerConfig()
+	config.AggregateSize = 1000
+	config.BufferWindow = time.Hour
+	config.Client = client
+	config.ShardRefreshInterval = 10 * time.Millisecond
+	config.StreamName = "foo"
+	p, err := NewProducer(config)
+	assert.Nil(t, err)
+
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	aggregated := make(chan *kinesis.PutRecordsRequestEntry, 20)
+	go p.aggregate(entries, aggregated)
+	send := func(i int) {
+		entries <- &kinesis.PutRecordsRequestEntry{
+			Data:            []byte(fmt.Sprintf("record-%d", i)),
+			ExplicitHashKey: aws.String(fmt.Sprintf("%d", 50+i%2*100)),
+			PartitionKey:    aws.String(fmt.Sprintf("%d", i)),
+		}
+	}
+	// records are packed together while the stream has a single shard, and
+	// emitted once the shard has been split
+	send(0)
+	send(1)
+	for atomic.LoadInt32(&client.calls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	send(2)
+	send(3)
+	close(entries)
+
+	records := [][]string{}
+	for e := range aggregated {
+		keys := []string{*e.PartitionKey}
+		if kpl.Aggregated(e.Data) {
+			users, err := kpl.Deaggregate(e.Data)
+			assert.Nil(t, err)
+			keys = []string{}
+			for _, u := range users {
+				keys = append(keys, *u.PartitionKey)
+			}
+		}
+		records = append(records, keys)
+	}
+	assert.Len(t, records, 3)
+	assert.Equal(t, []string{"0", "1"}, records[0])
+	assert.ElementsMatch(t, [][]string{{"2"}, {"3"}}, records[1:])
+}
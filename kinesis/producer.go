@@ -1,6 +1,8 @@
 package kinesis
 
 import (
+	"errors"
+	"s3-kinesis-replay/replay"
 	"s3-kinesis-replay/validate"
 	"sync"
 	"time"
@@ -11,15 +13,30 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// maxBatchBytes is the maximum total size of the records in a PutRecords
+// request, including partition keys
+const maxBatchBytes = 5 * 1024 * 1024
+
+// errInvalidHashKey is returned when a shard's hash key range cannot be parsed
+var errInvalidHashKey = errors.New("invalid shard hash key range")
+
 // Producer implements a replay producer that uses kinesis batch writes
 // as the streaming mechanism
 type Producer struct {
+	// The maximum size of kpl aggregated records, or 0 to disable aggregation
+	aggregateSize int
+	// The user records of each pending aggregated record
+	aggregated   map[*kinesis.PutRecordsRequestEntry][]*kinesis.PutRecordsRequestEntry
 	backoff      *backoff.ExponentialBackOff
 	bufferWindow time.Duration
 	client       kinesisiface.KinesisAPI
 	log          logrus.FieldLogger
-	streamName   *string
-	wg           *sync.WaitGroup
+	mu           sync.Mutex
+	// How often the stream's shards are described again while aggregating
+	shardRefreshInterval time.Duration
+	streamName           *string
+	tracker              replay.Tracker
+	wg                   *sync.WaitGroup
 }
 
 // NewProducer returns a new kinesis producer
@@ -35,41 +52,61 @@ func NewProducer(c *ProducerConfig) (*Producer, error) {
 	b.MaxInterval = c.BackoffMaxInterval
 	// create new producer
 	p := &Producer{
-		backoff:      b,
-		bufferWindow: c.BufferWindow,
-		client:       c.Client,
-		log:          c.Log,
-		streamName:   &c.StreamName,
-		wg:           &sync.WaitGroup{},
+		aggregateSize:        c.AggregateSize,
+		aggregated:           map[*kinesis.PutRecordsRequestEntry][]*kinesis.PutRecordsRequestEntry{},
+		backoff:              b,
+		bufferWindow:         c.BufferWindow,
+		client:               c.Client,
+		log:                  c.Log,
+		shardRefreshInterval: c.ShardRefreshInterval,
+		streamName:           &c.StreamName,
+		tracker:              c.Tracker,
+		wg:                   &sync.WaitGroup{},
 	}
 	return p, nil
 }
 
 // bufferWithTimeOrCount continues adding incoming entries to the current batch until
-// the it reaches the specified max size or the timeout is reached
-func (p *Producer) bufferWithTimeOrCount(entries chan *kinesis.PutRecordsRequestEntry, first *kinesis.PutRecordsRequestEntry, max int, window time.Duration) []*kinesis.PutRecordsRequestEntry {
+// the it reaches the specified max size or the timeout is reached. An entry that would
+// exceed the max bytes of the batch is returned to begin the next batch.
+func (p *Producer) bufferWithTimeOrCount(entries chan *kinesis.PutRecordsRequestEntry, first *kinesis.PutRecordsRequestEntry, max int, maxBytes int, window time.Duration) ([]*kinesis.PutRecordsRequestEntry, *kinesis.PutRecordsRequestEntry) {
 	batch := []*kinesis.PutRecordsRequestEntry{first}
 	timeout := time.After(window)
 	n := len(batch)
+	size := entrySize(first)
 	for {
 		select {
 		case <-timeout:
-			return batch
+			return batch, nil
 		case e, ok := <-entries:
 			// exit if channel has closed
 			if !ok {
-				return batch
+				return batch, nil
+			}
+			// start the next batch with entries that do not fit
+			if size+entrySize(e) > maxBytes {
+				return batch, e
 			}
 			// add entry to batch
 			batch = append(batch, e)
 			n++
+			size += entrySize(e)
 			if n >= max {
-				return batch
+				return batch, nil
 			}
 		}
 	}
 }
 
+// entrySize returns the size of an entry counted against request limits
+func entrySize(e *kinesis.PutRecordsRequestEntry) int {
+	size := len(e.Data)
+	if e.PartitionKey != nil {
+		size += len(*e.PartitionKey)
+	}
+	return size
+}
+
 // Process incoming stream of kinesis entries by bulk writing to kinesis with
 // error handling
 func (p *Producer) process(entries chan *kinesis.PutRecordsRequestEntry) {
@@ -77,10 +114,20 @@ func (p *Producer) process(entries chan *kinesis.PutRecordsRequestEntry) {
 	params := &kinesis.PutRecordsInput{
 		StreamName: p.streamName,
 	}
-	// continuously read
-	for e := range entries {
+	// continuously read, beginning each batch with any entry left over from
+	// the previous batch
+	var next *kinesis.PutRecordsRequestEntry
+	for {
+		e := next
+		if e == nil {
+			var ok bool
+			if e, ok = <-entries; !ok {
+				break
+			}
+		}
 		// create batch
-		batch := p.bufferWithTimeOrCount(entries, e, 500, p.bufferWindow)
+		var batch []*kinesis.PutRecordsRequestEntry
+		batch, next = p.bufferWithTimeOrCount(entries, e, 500, maxBatchBytes, p.bufferWindow)
 		params.Records = batch
 
 		// batch write to kinesis
@@ -106,8 +153,14 @@ func (p *Producer) process(entries chan *kinesis.PutRecordsRequestEntry) {
 					if entry.ErrorCode != nil {
 						failed = append(failed, params.Records[i])
 						p.log.WithError(err).Warnln("kinesis record error")
+					} else if p.tracker != nil {
+						p.written(params.Records[i])
 					}
 				}
+			} else if p.tracker != nil {
+				for _, entry := range params.Records {
+					p.written(entry)
+				}
 			}
 
 			// if throttling errors detected, pause briefly
@@ -123,11 +176,34 @@ func (p *Producer) process(entries chan *kinesis.PutRecordsRequestEntry) {
 	p.wg.Done()
 }
 
+// written notifies the tracker that an entry has been written, or each of
+// its user records if it is an aggregated record
+func (p *Producer) written(entry *kinesis.PutRecordsRequestEntry) {
+	p.mu.Lock()
+	users, ok := p.aggregated[entry]
+	delete(p.aggregated, entry)
+	p.mu.Unlock()
+	if !ok {
+		p.tracker.Written(entry)
+		return
+	}
+	for _, u := range users {
+		p.tracker.Written(u)
+	}
+}
+
 // Stream returns a channel that accepts kinesis messages to replay which
-// are buffered by time/count and written in bulk to kinesis
+// are buffered by time/count and written in bulk to kinesis, packing them
+// into kpl aggregated records first if aggregation is enabled
 func (p *Producer) Stream() chan *kinesis.PutRecordsRequestEntry {
 	entries := make(chan *kinesis.PutRecordsRequestEntry, 1000)
 	p.wg.Add(1)
+	if p.aggregateSize > 0 {
+		aggregated := make(chan *kinesis.PutRecordsRequestEntry, 1000)
+		go p.aggregate(entries, aggregated)
+		go p.process(aggregated)
+		return entries
+	}
 	go p.process(entries)
 	return entries
 }
@@ -139,21 +215,28 @@ func (p *Producer) Wait() {
 
 // ProducerConfig defines producer configuration settings
 type ProducerConfig struct {
+	// An optional maximum size of kpl aggregated records, leaving room for a
+	// partition key within the 1 MiB record limit
+	AggregateSize      int                     `validate:"min=0,max=1048320"`
 	BackoffInterval    time.Duration           `validate:"required"`
 	BackoffMaxInterval time.Duration           `validate:"required"`
 	BufferWindow       time.Duration           `validate:"required"`
 	Client             kinesisiface.KinesisAPI `validate:"required"`
 	Log                logrus.FieldLogger      `validate:"required"`
-	StreamName         string                  `validate:"required"`
+	// How often the stream's shards are described again while aggregating
+	ShardRefreshInterval time.Duration  `validate:"required"`
+	StreamName           string         `validate:"required"`
+	Tracker              replay.Tracker `validate:"-"`
 }
 
 // NewProducerConfig returns a new ProducerConfig value with appropriate
 // defaults
 func NewProducerConfig() *ProducerConfig {
 	return &ProducerConfig{
-		BackoffInterval:    time.Millisecond * 500,
-		BackoffMaxInterval: time.Minute,
-		BufferWindow:       time.Second * 10,
-		Log:                logrus.WithField("package", "kinesis"),
+		BackoffInterval:      time.Millisecond * 500,
+		BackoffMaxInterval:   time.Minute,
+		BufferWindow:         time.Second * 10,
+		Log:                  logrus.WithField("package", "kinesis"),
+		ShardRefreshInterval: time.Minute,
 	}
 }
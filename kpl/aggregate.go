@@ -0,0 +1,159 @@
+package kpl
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Aggregator packs user records into a single aggregated record
+type Aggregator struct {
+	// The user records added since the last reset
+	entries []*kinesis.PutRecordsRequestEntry
+	// The explicit hash key table and the index of each key
+	explicitHashKeys     map[string]uint64
+	explicitHashKeyTable []string
+	// The partition key table and the index of each key
+	partitionKeys     map[string]uint64
+	partitionKeyTable []string
+	// The encoded record fields of the AggregatedRecord message
+	records []byte
+	// The size of the encoded AggregatedRecord message
+	size int
+}
+
+// NewAggregator returns a new, empty aggregator
+func NewAggregator() *Aggregator {
+	a := &Aggregator{}
+	a.Reset()
+	return a
+}
+
+// Len returns the number of user records added since the last reset
+func (a *Aggregator) Len() int {
+	return len(a.entries)
+}
+
+// Entries returns the user records added since the last reset
+func (a *Aggregator) Entries() []*kinesis.PutRecordsRequestEntry {
+	return a.entries
+}
+
+// Size returns the size of the aggregated record's data if entry were added
+func (a *Aggregator) Size(entry *kinesis.PutRecordsRequestEntry) int {
+	return len(Magic) + a.size + a.grow(entry) + md5.Size
+}
+
+// Add appends a user record to the aggregated record
+func (a *Aggregator) Add(entry *kinesis.PutRecordsRequestEntry) {
+	a.size += a.grow(entry)
+	partitionKey := aws.StringValue(entry.PartitionKey)
+	index, ok := a.partitionKeys[partitionKey]
+	if !ok {
+		index = uint64(len(a.partitionKeyTable))
+		a.partitionKeys[partitionKey] = index
+		a.partitionKeyTable = append(a.partitionKeyTable, partitionKey)
+	}
+	record := appendVarint(nil, fieldPartitionKeyIndex, index)
+	if entry.ExplicitHashKey != nil {
+		index, ok := a.explicitHashKeys[*entry.ExplicitHashKey]
+		if !ok {
+			index = uint64(len(a.explicitHashKeyTable))
+			a.explicitHashKeys[*entry.ExplicitHashKey] = index
+			a.explicitHashKeyTable = append(a.explicitHashKeyTable, *entry.ExplicitHashKey)
+		}
+		record = appendVarint(record, fieldExplicitHashKeyIndex, index)
+	}
+	record = appendBytes(record, fieldData, entry.Data)
+	a.records = appendBytes(a.records, fieldRecords, record)
+	a.entries = append(a.entries, entry)
+}
+
+// Aggregate returns the aggregated record of the user records added since
+// the last reset, with the partition key of the first user record and an
+// optional explicit hash key
+func (a *Aggregator) Aggregate(explicitHashKey *string) *kinesis.PutRecordsRequestEntry {
+	message := make([]byte, 0, a.size)
+	for _, key := range a.partitionKeyTable {
+		message = appendBytes(message, fieldPartitionKeyTable, []byte(key))
+	}
+	for _, key := range a.explicitHashKeyTable {
+		message = appendBytes(message, fieldExplicitHashKeyTable, []byte(key))
+	}
+	message = append(message, a.records...)
+	sum := md5.Sum(message)
+	data := make([]byte, 0, len(Magic)+len(message)+md5.Size)
+	data = append(append(append(data, Magic...), message...), sum[:]...)
+	return &kinesis.PutRecordsRequestEntry{
+		Data:            data,
+		ExplicitHashKey: explicitHashKey,
+		PartitionKey:    a.entries[0].PartitionKey,
+	}
+}
+
+// Reset empties the aggregator
+func (a *Aggregator) Reset() {
+	a.entries = nil
+	a.explicitHashKeys = map[string]uint64{}
+	a.explicitHashKeyTable = nil
+	a.partitionKeys = map[string]uint64{}
+	a.partitionKeyTable = nil
+	a.records = nil
+	a.size = 0
+}
+
+// grow returns the number of bytes adding entry would add to the
+// AggregatedRecord message
+func (a *Aggregator) grow(entry *kinesis.PutRecordsRequestEntry) int {
+	size := 0
+	partitionKey := aws.StringValue(entry.PartitionKey)
+	index, ok := a.partitionKeys[partitionKey]
+	if !ok {
+		index = uint64(len(a.partitionKeyTable))
+		size += bytesSize(len(partitionKey))
+	}
+	record := varintSize(index)
+	if entry.ExplicitHashKey != nil {
+		index, ok := a.explicitHashKeys[*entry.ExplicitHashKey]
+		if !ok {
+			index = uint64(len(a.explicitHashKeyTable))
+			size += bytesSize(len(*entry.ExplicitHashKey))
+		}
+		record += varintSize(index)
+	}
+	record += bytesSize(len(entry.Data))
+	return size + bytesSize(record)
+}
+
+// varintSize returns the encoded size of a varint protobuf field with a
+// single byte key
+func varintSize(n uint64) int {
+	return 1 + len(appendUvarint(nil, n))
+}
+
+// bytesSize returns the encoded size of a length-delimited protobuf field
+// with a single byte key
+func bytesSize(n int) int {
+	return 1 + len(appendUvarint(nil, uint64(n))) + n
+}
+
+// appendVarint appends a varint protobuf field to b
+func appendVarint(b []byte, field int, n uint64) []byte {
+	b = appendUvarint(b, uint64(field<<3|wireVarint))
+	return appendUvarint(b, n)
+}
+
+// appendBytes appends a length-delimited protobuf field to b
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = appendUvarint(b, uint64(field<<3|wireBytes))
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendUvarint appends a varint to b
+func appendUvarint(b []byte, n uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, n)]...)
+}
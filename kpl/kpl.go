@@ -0,0 +1,265 @@
+// Package kpl implements the kinesis producer library's record aggregation
+// format, in which many user records are packed into a single kinesis record
+// as a protobuf AggregatedRecord message, preceded by magic bytes and
+// followed by the message's md5 checksum
+package kpl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Magic is the prefix that identifies an aggregated record
+var Magic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+const (
+	// protobuf field numbers of the AggregatedRecord message
+	fieldPartitionKeyTable    = 1
+	fieldExplicitHashKeyTable = 2
+	fieldRecords              = 3
+	// protobuf field numbers of the Record message
+	fieldPartitionKeyIndex    = 1
+	fieldExplicitHashKeyIndex = 2
+	fieldData                 = 3
+	// protobuf wire types
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	// ErrChecksum is returned when an aggregated record's md5 checksum does
+	// not match its message
+	ErrChecksum = errors.New("kpl aggregated record checksum mismatch")
+	// errMalformed is returned when an aggregated record's message cannot be
+	// decoded
+	errMalformed = errors.New("malformed kpl aggregated record")
+)
+
+// Aggregated determines whether data is an aggregated record
+func Aggregated(data []byte) bool {
+	return len(data) >= len(Magic)+md5.Size && bytes.HasPrefix(data, Magic)
+}
+
+// maxSize bounds the size of an aggregated record read from a stream, at the
+// largest record kinesis accepts
+const maxSize = 1024 * 1024
+
+// Reader reads consecutive aggregated records from a stream, such as a
+// firehose delivery of a stream's aggregated records, one at a time
+type Reader struct {
+	buf []byte
+	err error
+	r   io.Reader
+}
+
+// NewReader returns a reader of the aggregated records in a stream
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next returns the next aggregated record of the stream, or io.EOF once the
+// stream has been read. A record ends at the first following magic prefix,
+// or the end of the stream, at which its checksum matches, so magic bytes
+// within user data are not mistaken for the start of a record. ErrChecksum is
+// returned if a record's checksum never matches.
+func (r *Reader) Next() ([]byte, error) {
+	for len(r.buf) < len(Magic)+md5.Size && r.err == nil {
+		r.fill()
+	}
+	if len(r.buf) == 0 || r.err != nil && r.err != io.EOF {
+		return nil, r.err
+	}
+	if !Aggregated(r.buf) {
+		return nil, errMalformed
+	}
+	// hash the message incrementally as the candidate ends advance
+	h := md5.New()
+	hashed := len(Magic)
+	matches := func(end int) bool {
+		if end-md5.Size < hashed {
+			return false
+		}
+		h.Write(r.buf[hashed : end-md5.Size])
+		hashed = end - md5.Size
+		return bytes.Equal(h.Sum(nil), r.buf[hashed:end])
+	}
+	from := len(Magic)
+	for {
+		if n := bytes.Index(r.buf[from:], Magic); n >= 0 {
+			end := from + n
+			if matches(end) {
+				return r.next(end), nil
+			}
+			from = end + 1
+			continue
+		}
+		if r.err != nil && r.err != io.EOF {
+			return nil, r.err
+		}
+		if r.err != nil {
+			if matches(len(r.buf)) {
+				return r.next(len(r.buf)), nil
+			}
+			return nil, ErrChecksum
+		}
+		if len(r.buf) > maxSize {
+			return nil, ErrChecksum
+		}
+		// a magic prefix may span the end of the buffer
+		if end := len(r.buf) - len(Magic) + 1; end > from {
+			from = end
+		}
+		r.fill()
+	}
+}
+
+// next consumes the first n bytes of the buffer, returning them
+func (r *Reader) next(n int) []byte {
+	record := r.buf[:n]
+	r.buf = r.buf[n:]
+	return record
+}
+
+// fill reads more of the stream into the buffer
+func (r *Reader) fill() {
+	for r.err == nil {
+		if cap(r.buf)-len(r.buf) < bytes.MinRead {
+			buf := make([]byte, len(r.buf), 2*len(r.buf)+32*1024)
+			copy(buf, r.buf)
+			r.buf = buf
+		}
+		n, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+n]
+		r.err = err
+		if n > 0 {
+			return
+		}
+	}
+}
+
+// Deaggregate expands an aggregated record into its user records, each with
+// the partition key and explicit hash key referenced from the record's key
+// tables
+func Deaggregate(data []byte) ([]*kinesis.PutRecordsRequestEntry, error) {
+	if !Aggregated(data) {
+		return nil, errMalformed
+	}
+	message := data[len(Magic) : len(data)-md5.Size]
+	sum := md5.Sum(message)
+	if !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		return nil, ErrChecksum
+	}
+	partitionKeys := []string{}
+	explicitHashKeys := []string{}
+	records := [][]byte{}
+	err := fields(message, func(field int, value []byte, n uint64) error {
+		// tables and records are length-delimited
+		if value == nil && field <= fieldRecords {
+			return errMalformed
+		}
+		switch field {
+		case fieldPartitionKeyTable:
+			partitionKeys = append(partitionKeys, string(value))
+		case fieldExplicitHashKeyTable:
+			explicitHashKeys = append(explicitHashKeys, string(value))
+		case fieldRecords:
+			records = append(records, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*kinesis.PutRecordsRequestEntry, 0, len(records))
+	for _, r := range records {
+		entry := &kinesis.PutRecordsRequestEntry{Data: []byte{}}
+		partitionKey := -1
+		err := fields(r, func(field int, value []byte, n uint64) error {
+			// indexes are varints and data is length-delimited
+			if field == fieldData && value == nil || field < fieldData && value != nil {
+				return errMalformed
+			}
+			switch field {
+			case fieldPartitionKeyIndex:
+				if n >= uint64(len(partitionKeys)) {
+					return errMalformed
+				}
+				partitionKey = int(n)
+			case fieldExplicitHashKeyIndex:
+				if n >= uint64(len(explicitHashKeys)) {
+					return errMalformed
+				}
+				entry.ExplicitHashKey = aws.String(explicitHashKeys[n])
+			case fieldData:
+				entry.Data = append([]byte{}, value...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if partitionKey < 0 {
+			return nil, errMalformed
+		}
+		entry.PartitionKey = aws.String(partitionKeys[partitionKey])
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// fields decodes the fields of a protobuf message, calling fn with each
+// field's number and either its length-delimited value or, with a nil value,
+// its varint. fixed width fields are skipped.
+func fields(message []byte, fn func(field int, value []byte, n uint64) error) error {
+	for len(message) > 0 {
+		key, l := binary.Uvarint(message)
+		if l <= 0 {
+			return errMalformed
+		}
+		message = message[l:]
+		field := int(key >> 3)
+		var value []byte
+		var n uint64
+		switch key & 7 {
+		case wireVarint:
+			n, l = binary.Uvarint(message)
+			if l <= 0 {
+				return errMalformed
+			}
+			message = message[l:]
+		case wireBytes:
+			size, l := binary.Uvarint(message)
+			if l <= 0 || size > uint64(len(message)-l) {
+				return errMalformed
+			}
+			value = message[l : l+int(size)]
+			message = message[l+int(size):]
+		case wireFixed64:
+			if len(message) < 8 {
+				return errMalformed
+			}
+			message = message[8:]
+			continue
+		case wireFixed32:
+			if len(message) < 4 {
+				return errMalformed
+			}
+			message = message[4:]
+			continue
+		default:
+			return errMalformed
+		}
+		if err := fn(field, value, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package kpl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeaggregate(t *testing.T) {
+	message := appendBytes(nil, fieldPartitionKeyTable, []byte("a"))
+	message = appendBytes(message, fieldPartitionKeyTable, []byte("b"))
+	message = appendBytes(message, fieldExplicitHashKeyTable, []byte("123"))
+	record := appendVarint(nil, fieldPartitionKeyIndex, 1)
+	record = appendVarint(record, fieldExplicitHashKeyIndex, 0)
+	record = appendBytes(record, fieldData, []byte("foo"))
+	message = appendBytes(message, fieldRecords, record)
+	// records may include tags, which are skipped
+	record = appendVarint(nil, fieldPartitionKeyIndex, 0)
+	record = appendBytes(record, fieldData, []byte("bar"))
+	record = appendBytes(record, 4, appendBytes(nil, 1, []byte("tag")))
+	message = appendBytes(message, fieldRecords, record)
+	sum := md5.Sum(message)
+	data := append(append(append([]byte{}, Magic...), message...), sum[:]...)
+
+	assert.True(t, Aggregated(data))
+	assert.False(t, Aggregated([]byte(`{"foo":"bar"}`)))
+	entries, err := Deaggregate(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("foo"), ExplicitHashKey: aws.String("123"), PartitionKey: aws.String("b")},
+		{Data: []byte("bar"), PartitionKey: aws.String("a")},
+	}, entries)
+
+	// corrupt the message
+	data[len(Magic)+3] ^= 0xff
+	_, err = Deaggregate(data)
+	assert.Equal(t, ErrChecksum, err)
+}
+
+func TestReader(t *testing.T) {
+	aggregate := func(data string) []byte {
+		a := NewAggregator()
+		a.Add(&kinesis.PutRecordsRequestEntry{Data: []byte(data), PartitionKey: aws.String("a")})
+		return a.Aggregate(nil).Data
+	}
+	// user data containing the magic prefix does not end a record, even when
+	// the stream is read a byte at a time
+	first := aggregate("foo" + string(Magic) + "bar")
+	last := aggregate("qux")
+	r := NewReader(iotest.OneByteReader(bytes.NewReader(append(append([]byte{}, first...), last...))))
+	for _, expected := range [][]byte{first, last} {
+		record, err := r.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, record)
+	}
+	_, err := r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// a record whose checksum never matches is reported
+	corrupt := aggregate("baz")
+	corrupt[len(corrupt)-1] ^= 0xff
+	r = NewReader(bytes.NewReader(append(append(append([]byte{}, first...), corrupt...), last...)))
+	record, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, first, record)
+	_, err = r.Next()
+	assert.Equal(t, ErrChecksum, err)
+
+	// streams must begin with an aggregated record
+	_, err = NewReader(bytes.NewReader([]byte(`{"foo":"bar"}`))).Next()
+	assert.Equal(t, errMalformed, err)
+}
+
+func TestAggregate(t *testing.T) {
+	entries := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("foo"), PartitionKey: aws.String("a")},
+		{Data: make([]byte, 300), ExplicitHashKey: aws.String("123"), PartitionKey: aws.String("b")},
+		{Data: []byte{}, PartitionKey: aws.String("a")},
+	}
+	a := NewAggregator()
+	for _, e := range entries {
+		size := a.Size(e)
+		a.Add(e)
+		aggregated := a.Aggregate(aws.String("1"))
+		assert.Equal(t, size, len(aggregated.Data))
+	}
+	aggregated := a.Aggregate(aws.String("1"))
+	assert.Equal(t, "a", *aggregated.PartitionKey)
+	assert.Equal(t, entries, a.Entries())
+
+	// the aggregated record expands to the original user records
+	expanded, err := Deaggregate(aggregated.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, expanded)
+
+	a.Reset()
+	assert.Equal(t, 0, a.Len())
+}
@@ -0,0 +1,380 @@
+// Package local provides types and methods for consuming a message archive
+// stored on the local filesystem, either as a directory tree or a tar or zip
+// file
+package local
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3-kinesis-replay/decompress"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/validate"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+// Archive implements an archive that reads the files of a local directory
+// tree, tar file or zip file in lexical key order
+type Archive struct {
+	compression decompress.Format
+	log         logrus.FieldLogger
+	path        string
+	prefix      string
+	source      string
+	startAfter  string
+	stopAt      string
+	stopAtMode  string
+	tracker     replay.Tracker
+	wg          *sync.WaitGroup
+}
+
+// entry describes a file within a local archive
+type entry struct {
+	// the file path relative to the archive root, using / separators
+	key string
+	// the file modification time
+	modified time.Time
+	// the uncompressed file size
+	size int64
+	// opens a stream of the file data
+	open func() (io.ReadCloser, error)
+}
+
+// NewArchive returns a new local archive
+func NewArchive(c *ArchiveConfig) (*Archive, error) {
+	// validate configuration
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	// create new archive
+	a := &Archive{
+		compression: decompress.Format(c.Compression),
+		log:         c.Log,
+		path:        c.Path,
+		prefix:      c.Prefix,
+		source:      c.Source,
+		startAfter:  c.StartAfter,
+		stopAt:      c.StopAt,
+		stopAtMode:  c.StopAtMode,
+		tracker:     c.Tracker,
+		wg:          &sync.WaitGroup{},
+	}
+	// identify the archive source by its location if not named explicitly
+	if a.source == "" {
+		a.source = SourceID(c.Path, c.Prefix)
+	}
+	// add optional parameters if valid
+	if a.compression == "" {
+		a.compression = decompress.Auto
+	} else if !a.compression.Valid() {
+		return nil, errors.New("invalid compression format: " + c.Compression)
+	}
+	if !replay.ValidStopMode(c.StopAtMode) {
+		return nil, errors.New("invalid stop at mode: " + c.StopAtMode)
+	}
+	return a, nil
+}
+
+// SourceID returns the default identifier of a local archive source
+func SourceID(path, prefix string) string {
+	return "file://" + filepath.ToSlash(path) + "/" + prefix
+}
+
+// Scan reads the archive's files in key order, emitting them on the returned
+// channel
+func (a *Archive) Scan() chan *replay.Object {
+	objects := make(chan *replay.Object)
+	go a.scan(objects)
+	return objects
+}
+
+// scan emits the archive's files within the configured prefix after the
+// start key, stopping either when the stop at key is found or all files have
+// been read, and releases the archive once all emitted files are closed
+func (a *Archive) scan(objects chan *replay.Object) {
+	entries, closer, err := a.list()
+	if err != nil {
+		a.log.WithError(err).Errorln("scan:error")
+		close(objects)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for _, e := range entries {
+		if !strings.HasPrefix(e.key, a.prefix) || (a.startAfter != "" && e.key <= a.startAfter) {
+			continue
+		}
+		if a.stopAt != "" && replay.StopReached(e.key, a.stopAt, a.stopAtMode) {
+			a.log.WithField("key", e.key).Infoln("stopping at stop key")
+			break
+		}
+		body, err := a.open(e)
+		if err != nil {
+			a.log.WithError(err).WithField("key", e.key).Errorln("error opening file")
+			continue
+		}
+		a.log.WithFields(logrus.Fields{
+			"size": e.size,
+			"key":  e.key,
+		}).Debugln("file opened")
+		if a.tracker != nil {
+			a.tracker.Object(a.source, e.key)
+		}
+		objects <- &replay.Object{
+			Body: body,
+			Object: &s3.Object{
+				Key:          aws.String(e.key),
+				LastModified: aws.Time(e.modified),
+				Size:         aws.Int64(e.size),
+			},
+			Source: a.source,
+		}
+	}
+	a.log.Infoln("scan complete")
+	close(objects)
+	a.wg.Wait()
+	if closer == nil {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		a.log.WithError(err).Errorln("error closing archive")
+	}
+}
+
+// open returns a decompressing stream of a file's data, which releases the
+// archive when closed
+func (a *Archive) open(e *entry) (io.ReadCloser, error) {
+	body, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	r, format, err := decompress.Open(a.compression, "", e.key, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if format != decompress.None {
+		a.log.WithFields(logrus.Fields{
+			"format": format,
+			"key":    e.key,
+		}).Debugln("decompressing file")
+	}
+	a.wg.Add(1)
+	return &readCloser{Reader: r, closers: []io.Closer{r, body}, wg: a.wg, once: &sync.Once{}}, nil
+}
+
+// list returns the files within the archive, along with an optional closer
+// that releases any resources held by the archive
+func (a *Archive) list() ([]*entry, io.Closer, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case info.IsDir():
+		entries, err := listDir(a.path)
+		return entries, nil, err
+	case strings.ToLower(filepath.Ext(a.path)) == ".zip":
+		return listZip(a.path)
+	default:
+		return listTar(a.path)
+	}
+}
+
+// listDir returns the regular files within a directory tree
+func listDir(root string) ([]*entry, error) {
+	entries := []*entry{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &entry{
+			key:      filepath.ToSlash(rel),
+			modified: info.ModTime(),
+			size:     info.Size(),
+			open: func() (io.ReadCloser, error) {
+				return os.Open(path)
+			},
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// listZip returns the regular files within a zip file
+func listZip(path string) ([]*entry, io.Closer, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []*entry{}
+	for _, f := range r.File {
+		info := f.FileInfo()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, &entry{
+			key:      strings.TrimPrefix(f.Name, "./"),
+			modified: info.ModTime(),
+			size:     info.Size(),
+			open:     f.Open,
+		})
+	}
+	return entries, r, nil
+}
+
+// listTar returns the regular files within a tar file, which is first
+// decompressed to a temporary file if necessary so that its files can be read
+// out of order
+func listTar(path string) ([]*entry, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &tarCloser{file: f}
+	r, format, err := decompress.Open(decompress.Auto, "", path, f)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if format != decompress.None {
+		tmp, err := ioutil.TempFile("", "archive")
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		c.tmp = tmp
+		_, err = io.Copy(tmp, r)
+		r.Close()
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		f = tmp
+	}
+	// index the offset of each file's data, which is stored contiguously
+	entries := []*entry{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		file, size := f, hdr.Size
+		entries = append(entries, &entry{
+			key:      strings.TrimPrefix(hdr.Name, "./"),
+			modified: hdr.ModTime,
+			size:     size,
+			open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(file, offset, size)), nil
+			},
+		})
+	}
+	return entries, c, nil
+}
+
+// tarCloser closes a tar file and removes its decompressed copy, if any
+type tarCloser struct {
+	file *os.File
+	tmp  *os.File
+}
+
+// Close closes the tar file and removes any temporary file
+func (c *tarCloser) Close() error {
+	err := c.file.Close()
+	if c.tmp != nil {
+		c.tmp.Close()
+		os.Remove(c.tmp.Name())
+	}
+	return err
+}
+
+// readCloser is a reader that closes a chain of underlying streams and
+// signals that the file has been released
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+	once    *sync.Once
+	wg      *sync.WaitGroup
+}
+
+// Close closes each of the underlying streams, returning the first error
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	r.once.Do(r.wg.Done)
+	return err
+}
+
+// ArchiveConfig defines a local archive configuration
+type ArchiveConfig struct {
+	// An optional compression format override for the archive's files,
+	// defaults to detecting the format of each file
+	Compression string `validate:"-"`
+	// An archive scoped logger
+	Log logrus.FieldLogger `validate:"required"`
+	// The path of a directory, tar file (optionally compressed) or zip file
+	// that contains the archive
+	Path string `validate:"required"`
+	// An optional key prefix that contains the relevant archive portion
+	Prefix string `validate:"-"`
+	// An optional identifier for the archive source, used to distinguish the
+	// progress of multiple sources, defaults to file://<path>/<prefix>
+	Source string `validate:"-"`
+	// An optional key to begin replay after
+	StartAfter string `validate:"-"`
+	// An optional upper bound on the keys to replay
+	StopAt string `validate:"-"`
+	// An optional mode determining how the stop at key bounds the keys to
+	// replay, one of exclusive (default), inclusive or prefix
+	StopAtMode string `validate:"-"`
+	// An optional tracker to notify of emitted files
+	Tracker replay.Tracker `validate:"-"`
+}
+
+// NewArchiveConfig returns a local archive config value with appropriate
+// defaults
+func NewArchiveConfig() *ArchiveConfig {
+	return &ArchiveConfig{
+		Log: logrus.WithField("package", "local"),
+	}
+}
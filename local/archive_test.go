@@ -0,0 +1,101 @@
+package local
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// files defines archive contents whose lexical key order differs from a
+// depth-first walk
+var files = map[string]string{
+	"stream/a.json":    `{"key":"a.json"}`,
+	"stream/a/b.json":  `{"key":"a/b.json"}`,
+	"stream/c.json.gz": `{"key":"c.json.gz"}`,
+	"stream/d.json":    `{"key":"d.json"}`,
+	"other/e.json":     `{"key":"e.json"}`,
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// write the archive as a directory tree, a gzip'd tar file and a zip file
+	root := filepath.Join(dir, "root")
+	tgz, err := os.Create(filepath.Join(dir, "archive.tar.gz"))
+	assert.Nil(t, err)
+	gz := gzip.NewWriter(tgz)
+	tw := tar.NewWriter(gz)
+	zf, err := os.Create(filepath.Join(dir, "archive.zip"))
+	assert.Nil(t, err)
+	zw := zip.NewWriter(zf)
+	for key, data := range files {
+		b := []byte(data)
+		if filepath.Ext(key) == ".gz" {
+			b = gzipBytes(t, b)
+		}
+		path := filepath.Join(root, filepath.FromSlash(key))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, b, 0644))
+		assert.Nil(t, tw.WriteHeader(&tar.Header{
+			Name:     "./" + key,
+			Mode:     0644,
+			ModTime:  time.Now(),
+			Size:     int64(len(b)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err = tw.Write(b)
+		assert.Nil(t, err)
+		w, err := zw.Create(key)
+		assert.Nil(t, err)
+		_, err = w.Write(b)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	assert.Nil(t, tgz.Close())
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, zf.Close())
+
+	for _, path := range []string{root, tgz.Name(), zf.Name()} {
+		config := NewArchiveConfig()
+		config.Log = logrus.WithField("test", true)
+		config.Path = path
+		config.Prefix = "stream/"
+		config.StartAfter = "stream/a.json"
+		config.StopAt = "stream/d.json"
+		archive, err := NewArchive(config)
+		assert.Nil(t, err)
+
+		// files are emitted in key order, decompressed
+		keys, bodies := []string{}, []string{}
+		for o := range archive.Scan() {
+			b, err := ioutil.ReadAll(o.Body)
+			assert.Nil(t, err)
+			assert.Nil(t, o.Body.Close())
+			keys = append(keys, *o.Object.Key)
+			bodies = append(bodies, string(b))
+		}
+		assert.Equal(t, []string{"stream/a/b.json", "stream/c.json.gz"}, keys, path)
+		assert.Equal(t, []string{files["stream/a/b.json"], files["stream/c.json.gz"]}, bodies, path)
+	}
+}
+
+// gzipBytes compresses b
+func gzipBytes(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write(b)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
@@ -13,15 +13,35 @@ func main() {
 	viper.AddConfigPath(".")
 
 	// bind environment variables
+	viper.BindEnv("checkpoint.file", "CHECKPOINT_FILE")
+	viper.BindEnv("checkpoint.interval", "CHECKPOINT_INTERVAL")
+	viper.BindEnv("checkpoint.resume", "CHECKPOINT_RESUME")
+	viper.BindEnv("cloudwatch.concurrency", "CLOUDWATCH_CONCURRENCY")
+	viper.BindEnv("cloudwatch.output", "CLOUDWATCH_OUTPUT")
+	viper.BindEnv("cloudwatch.partition_key", "CLOUDWATCH_PARTITION_KEY")
+	viper.BindEnv("csv.concurrency", "CSV_CONCURRENCY")
+	viper.BindEnv("csv.header", "CSV_HEADER")
+	viper.BindEnv("csv.partition_key", "CSV_PARTITION_KEY")
 	viper.BindEnv("json.concurrency", "JSON_CONCURRENCY")
+	viper.BindEnv("json.deaggregate", "JSON_DEAGGREGATE")
+	viper.BindEnv("json.framing", "JSON_FRAMING")
 	viper.BindEnv("json.partition_key", "JSON_PARTITION_KEY")
+	viper.BindEnv("json.records_path", "JSON_RECORDS_PATH")
+	viper.BindEnv("json.sample_percent", "JSON_SAMPLE_PERCENT")
 	viper.BindEnv("json.schema", "JSON_SCHEMA")
+	viper.BindEnv("kinesis.aggregate_size", "KINESIS_AGGREGATE_SIZE")
 	viper.BindEnv("kinesis.backoff_interval", "KINESIS_BACKOFF_INTERVAL")
 	viper.BindEnv("kinesis.backoff_max_interval", "KINESIS_MAX_BACKOFF_INTERVAL")
 	viper.BindEnv("kinesis.buffer_size", "KINESIS_BUFFER_SIZE")
 	viper.BindEnv("kinesis.buffer_window", "KINESIS_BUFFER_WINDOW")
 	viper.BindEnv("kinesis.endpoint", "KINESIS_ENDPOINT")
+	viper.BindEnv("kinesis.external_id", "KINESIS_EXTERNAL_ID")
+	viper.BindEnv("kinesis.profile", "KINESIS_PROFILE")
 	viper.BindEnv("kinesis.region", "KINESIS_REGION")
+	viper.BindEnv("kinesis.role_arn", "KINESIS_ROLE_ARN")
+	viper.BindEnv("kinesis.role_duration", "KINESIS_ROLE_DURATION")
+	viper.BindEnv("kinesis.role_session_name", "KINESIS_ROLE_SESSION_NAME")
+	viper.BindEnv("kinesis.shard_refresh_interval", "KINESIS_SHARD_REFRESH_INTERVAL")
 	viper.BindEnv("kinesis.stream_name", "KINESIS_STREAM_NAME")
 	viper.BindEnv("log.format", "LOG_FORMAT")
 	viper.BindEnv("log.level", "LOG_LEVEL")
@@ -29,15 +49,65 @@ func main() {
 	viper.BindEnv("parser.format", "PARSER_FORMAT")
 	viper.BindEnv("parser.replace", "PARSER_REPLACE")
 	viper.BindEnv("parser.replace_with", "PARSER_REPLACE_WITH")
+	viper.BindEnv("parser.routes", "PARSER_ROUTES")
+	viper.BindEnv("s3.as_of", "S3_AS_OF")
 	viper.BindEnv("s3.bucket", "S3_BUCKET")
+	viper.BindEnv("s3.ca_bundle", "S3_CA_BUNDLE")
+	viper.BindEnv("s3.compression", "S3_COMPRESSION")
 	viper.BindEnv("s3.concurrency", "S3_CONCURRENCY")
 	viper.BindEnv("s3.endpoint", "S3_ENDPOINT")
+	viper.BindEnv("s3.exclude", "S3_EXCLUDE")
+	viper.BindEnv("s3.exclude_glob", "S3_EXCLUDE_GLOB")
+	viper.BindEnv("s3.expected_bucket_owner", "S3_EXPECTED_BUCKET_OWNER")
+	viper.BindEnv("s3.external_id", "S3_EXTERNAL_ID")
+	viper.BindEnv("s3.failed_report", "S3_FAILED_REPORT")
+	viper.BindEnv("s3.from", "S3_FROM")
+	viper.BindEnv("s3.include", "S3_INCLUDE")
+	viper.BindEnv("s3.include_glob", "S3_INCLUDE_GLOB")
+	viper.BindEnv("s3.inventory", "S3_INVENTORY")
+	viper.BindEnv("s3.key_template", "S3_KEY_TEMPLATE")
+	viper.BindEnv("s3.keys_file", "S3_KEYS_FILE")
+	viper.BindEnv("s3.list_concurrency", "S3_LIST_CONCURRENCY")
+	viper.BindEnv("s3.max_attempts", "S3_MAX_ATTEMPTS")
+	viper.BindEnv("s3.max_inflight_bytes", "S3_MAX_INFLIGHT_BYTES")
+	viper.BindEnv("s3.max_size", "S3_MAX_SIZE")
+	viper.BindEnv("s3.min_size", "S3_MIN_SIZE")
+	viper.BindEnv("s3.modified_after", "S3_MODIFIED_AFTER")
+	viper.BindEnv("s3.modified_before", "S3_MODIFIED_BEFORE")
+	viper.BindEnv("s3.order", "S3_ORDER")
+	viper.BindEnv("s3.ordered", "S3_ORDERED")
+	viper.BindEnv("s3.part_concurrency", "S3_PART_CONCURRENCY")
+	viper.BindEnv("s3.part_size", "S3_PART_SIZE")
+	viper.BindEnv("s3.path_style", "S3_PATH_STYLE")
 	viper.BindEnv("s3.prefix", "S3_PREFIX")
+	viper.BindEnv("s3.profile", "S3_PROFILE")
 	viper.BindEnv("s3.region", "S3_REGION")
+	viper.BindEnv("s3.requester_pays", "S3_REQUESTER_PAYS")
+	viper.BindEnv("s3.restore", "S3_RESTORE")
+	viper.BindEnv("s3.restore_days", "S3_RESTORE_DAYS")
+	viper.BindEnv("s3.restore_interval", "S3_RESTORE_INTERVAL")
+	viper.BindEnv("s3.restore_max_wait", "S3_RESTORE_MAX_WAIT")
+	viper.BindEnv("s3.restore_tier", "S3_RESTORE_TIER")
+	viper.BindEnv("s3.retry_interval", "S3_RETRY_INTERVAL")
+	viper.BindEnv("s3.retry_max_interval", "S3_RETRY_MAX_INTERVAL")
+	viper.BindEnv("s3.role_arn", "S3_ROLE_ARN")
+	viper.BindEnv("s3.role_duration", "S3_ROLE_DURATION")
+	viper.BindEnv("s3.role_session_name", "S3_ROLE_SESSION_NAME")
+	viper.BindEnv("s3.sample_every", "S3_SAMPLE_EVERY")
+	viper.BindEnv("s3.sample_percent", "S3_SAMPLE_PERCENT")
+	viper.BindEnv("s3.sources", "S3_SOURCES")
+	viper.BindEnv("s3.sse_customer_key_file", "S3_SSE_CUSTOMER_KEY_FILE")
 	viper.BindEnv("s3.start_after", "S3_START_AFTER")
 	viper.BindEnv("s3.stop_at", "S3_STOP_AT")
+	viper.BindEnv("s3.stop_at_mode", "S3_STOP_AT_MODE")
+	viper.BindEnv("s3.to", "S3_TO")
 
 	// set defaults
+	viper.SetDefault("checkpoint.interval", "10s")
+	viper.SetDefault("cloudwatch.concurrency", 4)
+	viper.SetDefault("cloudwatch.output", "raw")
+	viper.SetDefault("cloudwatch.partition_key", "logStream")
+	viper.SetDefault("csv.concurrency", 4)
 	viper.SetDefault("json.concurrency", 4)
 	viper.SetDefault("json.delimiter", ",")
 	viper.SetDefault("json.replace", "}[\r\n]*{")
@@ -45,9 +115,27 @@ func main() {
 	viper.SetDefault("kinesis.backoff_interval", "1s")
 	viper.SetDefault("kinesis.backoff_max_interval", "10s")
 	viper.SetDefault("kinesis.buffer_window", "10s")
+	viper.SetDefault("kinesis.role_duration", "1h")
+	viper.SetDefault("kinesis.role_session_name", "s3-kinesis-replay")
+	viper.SetDefault("kinesis.shard_refresh_interval", "1m")
 	viper.SetDefault("log.format", "json")
 	viper.SetDefault("log.level", "info")
+	viper.SetDefault("s3.compression", "auto")
 	viper.SetDefault("s3.concurrency", 4)
+	viper.SetDefault("s3.list_concurrency", 1)
+	viper.SetDefault("s3.max_attempts", 5)
+	viper.SetDefault("s3.order", "interleaved")
+	viper.SetDefault("s3.part_concurrency", 1)
+	viper.SetDefault("s3.part_size", 8388608)
+	viper.SetDefault("s3.restore_days", 1)
+	viper.SetDefault("s3.restore_interval", "1m")
+	viper.SetDefault("s3.restore_max_wait", "48h")
+	viper.SetDefault("s3.restore_tier", "Standard")
+	viper.SetDefault("s3.retry_interval", "1s")
+	viper.SetDefault("s3.retry_max_interval", "30s")
+	viper.SetDefault("s3.role_duration", "1h")
+	viper.SetDefault("s3.role_session_name", "s3-kinesis-replay")
+	viper.SetDefault("s3.stop_at_mode", "exclusive")
 
 	// read config file
 	err := viper.ReadInConfig()
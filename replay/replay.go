@@ -3,6 +3,8 @@
 package replay
 
 import (
+	"io"
+
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -14,11 +16,20 @@ type Archive interface {
 	Scan() chan *Object
 }
 
-// Object is a wrapper around an s3 object that includes the downloaded
+// Object is a wrapper around an s3 object that includes a stream of the
 // object data
 type Object struct {
-	Data   []byte
+	// Body streams the decompressed object data and must be closed by the
+	// parser once it has been consumed
+	Body io.ReadCloser
+	// ContentType is the object's content type, if known
+	ContentType string
+	// Fail, if set, reports that the object's body could not be fully read
+	// or parsed, so that it can be replayed again later
+	Fail   func(error)
 	Object *s3.Object
+	// Source identifies the archive source the object was read from
+	Source string
 }
 
 // Parser is responsible for processing the stream of archived s3 messages
@@ -34,3 +45,25 @@ type Producer interface {
 	// Wait for producer to finish replaying messages
 	Wait()
 }
+
+// Tracker is notified as archive objects and their records move through
+// the replay pipeline, allowing replay progress to be recorded
+type Tracker interface {
+	// Object registers an archive object key, in scan order, before it is
+	// queued for download
+	Object(source, key string)
+	// Record associates a pending kinesis entry with the object it was
+	// parsed from
+	Record(source, key string, entry *kinesis.PutRecordsRequestEntry)
+	// Parsed indicates that all records have been emitted for the object
+	Parsed(source, key string)
+	// Written indicates that a kinesis entry has been successfully written
+	Written(entry *kinesis.PutRecordsRequestEntry)
+}
+
+// Reporter is notified of archive objects that could not be replayed
+type Reporter interface {
+	// Failed records an archive object that could not be downloaded after
+	// exhausting all attempts, or whose body could not be fully read
+	Failed(bucket, key string, err error)
+}
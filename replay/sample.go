@@ -0,0 +1,16 @@
+package replay
+
+import "hash/fnv"
+
+// Sampled determines whether records with a partition key are included in a
+// sample of a percentage (0-100) of partition keys, consistently choosing the
+// same partition keys by hash. Every partition key is included in a sample of
+// 0 or 100 percent.
+func Sampled(partitionKey string, percent float64) bool {
+	if percent <= 0 || percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(partitionKey))
+	return float64(h.Sum32()%10000) < percent*100
+}
@@ -0,0 +1,23 @@
+package replay
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampled(t *testing.T) {
+	// expect a consistent sample of roughly the configured percentage of keys
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if Sampled(key, 10) {
+			sampled++
+			assert.True(t, Sampled(key, 10))
+		}
+		assert.True(t, Sampled(key, 0))
+		assert.True(t, Sampled(key, 100))
+	}
+	assert.InDelta(t, 1000, sampled, 200)
+}
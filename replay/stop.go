@@ -0,0 +1,39 @@
+package replay
+
+import "strings"
+
+// supported stop at modes, which determine how an archive's stop at key
+// bounds the keys it replays
+const (
+	// StopExclusive stops at the first key at or after the stop at key
+	StopExclusive = "exclusive"
+	// StopInclusive stops at the first key after the stop at key
+	StopInclusive = "inclusive"
+	// StopPrefix treats the stop at key as a prefix, stopping at the first
+	// key after all keys that begin with it
+	StopPrefix = "prefix"
+)
+
+// ValidStopMode determines whether a stop at mode is supported, where an
+// empty mode defaults to StopExclusive
+func ValidStopMode(mode string) bool {
+	switch mode {
+	case "", StopExclusive, StopInclusive, StopPrefix:
+		return true
+	}
+	return false
+}
+
+// StopReached determines whether a key is at or beyond the upper bound
+// described by a stop at key and mode, such that it and all following keys
+// must not be replayed
+func StopReached(key, stopAt, mode string) bool {
+	switch mode {
+	case StopInclusive:
+		return key > stopAt
+	case StopPrefix:
+		return key > stopAt && !strings.HasPrefix(key, stopAt)
+	default:
+		return key >= stopAt
+	}
+}
@@ -0,0 +1,207 @@
+// Package route implements a parser that dispatches archive objects to other
+// parsers by key, content type or leading bytes
+package route
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/validate"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/sirupsen/logrus"
+)
+
+// peekSize is the number of leading bytes of an object's decompressed data
+// available to magic byte signatures
+const peekSize = 512
+
+// Route maps objects matching all of its configured conditions to a parser
+type Route struct {
+	// An optional content type prefix the object's content type must have
+	ContentType string
+	// An optional pattern the object key must match
+	Key *regexp.Regexp
+	// An optional pattern the object's leading decompressed bytes must match
+	Magic *regexp.Regexp
+	// A name identifying the route in logs
+	Name string
+	// The parser for matching objects
+	Parser replay.Parser
+}
+
+// match determines whether an object satisfies each of the route's conditions
+func (r *Route) match(o *replay.Object, leading []byte) bool {
+	if r.ContentType != "" && !strings.HasPrefix(strings.ToLower(o.ContentType), strings.ToLower(r.ContentType)) {
+		return false
+	}
+	if r.Key != nil && !r.Key.MatchString(*o.Object.Key) {
+		return false
+	}
+	if r.Magic != nil && !r.Magic.Match(leading) {
+		return false
+	}
+	return true
+}
+
+// Router implements a parser that dispatches each object to the parser of
+// the first matching route
+type Router struct {
+	// An optional parser for objects that match no route
+	fallback replay.Parser
+	// A logger instance
+	log logrus.FieldLogger
+	// Whether records are emitted in object order
+	ordered bool
+	// The routes to match objects against, in order
+	routes []*Route
+	// An optional tracker to notify of objects that match no route
+	tracker replay.Tracker
+}
+
+// NewRouter returns a new router
+func NewRouter(c *RouterConfig) (*Router, error) {
+	// validate config
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{
+		fallback: c.Default,
+		log:      c.Log,
+		ordered:  c.Ordered,
+		routes:   c.Routes,
+		tracker:  c.Tracker,
+	}
+	return r, nil
+}
+
+// Parse starts each routed parser with its own stream of objects, dispatching
+// incoming objects to them and merging their records onto the entries stream.
+// Parse blocks until all parsers have completed.
+func (r *Router) Parse(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	if r.ordered {
+		r.parseOrdered(objects, entries)
+		return
+	}
+	// start each distinct parser once, even if shared by several routes
+	wg := &sync.WaitGroup{}
+	inputs := map[replay.Parser]chan *replay.Object{}
+	start := func(p replay.Parser) {
+		if p == nil || inputs[p] != nil {
+			return
+		}
+		in := make(chan *replay.Object)
+		out := make(chan *kinesis.PutRecordsRequestEntry)
+		inputs[p] = in
+		wg.Add(2)
+		go func() {
+			p.Parse(in, out)
+			wg.Done()
+		}()
+		go func() {
+			for e := range out {
+				entries <- e
+			}
+			wg.Done()
+		}()
+	}
+	for _, route := range r.routes {
+		start(route.Parser)
+	}
+	start(r.fallback)
+
+	for o := range objects {
+		p := r.route(o)
+		if p == nil {
+			r.skip(o)
+			continue
+		}
+		inputs[p] <- o
+	}
+	for _, in := range inputs {
+		close(in)
+	}
+	wg.Wait()
+	close(entries)
+}
+
+// parseOrdered parses one object at a time, so that the records of objects
+// routed to different parsers are still emitted in object order. Each object
+// is parsed by its parser in a stream of its own, whose records are all
+// emitted before the next object is routed.
+func (r *Router) parseOrdered(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for o := range objects {
+		p := r.route(o)
+		if p == nil {
+			r.skip(o)
+			continue
+		}
+		in := make(chan *replay.Object, 1)
+		out := make(chan *kinesis.PutRecordsRequestEntry)
+		in <- o
+		close(in)
+		go p.Parse(in, out)
+		for e := range out {
+			entries <- e
+		}
+	}
+	close(entries)
+}
+
+// skip closes an object that matches no route, marking it parsed
+func (r *Router) skip(o *replay.Object) {
+	r.log.WithField("key", *o.Object.Key).Warnln("skipping object that matches no route")
+	o.Body.Close()
+	if r.tracker != nil {
+		r.tracker.Parsed(o.Source, *o.Object.Key)
+	}
+}
+
+// route returns the parser for an object, wrapping its body so that bytes
+// read to match magic byte signatures are still available to the parser
+func (r *Router) route(o *replay.Object) replay.Parser {
+	log := r.log.WithField("key", *o.Object.Key)
+	var leading []byte
+	for _, route := range r.routes {
+		if route.Magic != nil && leading == nil {
+			br := bufio.NewReaderSize(o.Body, peekSize)
+			b, err := br.Peek(peekSize)
+			if err != nil && err != io.EOF {
+				log.WithError(err).Warnln("error reading leading bytes")
+			}
+			leading = append([]byte{}, b...)
+			o.Body = &body{Reader: br, Closer: o.Body}
+		}
+		if route.match(o, leading) {
+			log.WithField("route", route.Name).Debugln("routing object")
+			return route.Parser
+		}
+	}
+	return r.fallback
+}
+
+// body combines a buffered reader with the underlying object body
+type body struct {
+	io.Reader
+	io.Closer
+}
+
+// RouterConfig defines a router's configuration
+type RouterConfig struct {
+	Default replay.Parser      `validate:"-"`
+	Log     logrus.FieldLogger `validate:"required"`
+	Ordered bool               `validate:"-"`
+	Routes  []*Route           `validate:"-"`
+	Tracker replay.Tracker     `validate:"-"`
+}
+
+// NewRouterConfig returns a new config value with appropriate defaults
+func NewRouterConfig() *RouterConfig {
+	return &RouterConfig{
+		Log: logrus.WithField("package", "route"),
+	}
+}
@@ -0,0 +1,119 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"s3-kinesis-replay/replay"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// echo is a parser that emits each object's data prefixed with a name
+type echo string
+
+func (e echo) Parse(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for o := range objects {
+		b, _ := ioutil.ReadAll(o.Body)
+		o.Body.Close()
+		entries <- &kinesis.PutRecordsRequestEntry{
+			Data:         append([]byte(string(e)+":"), b...),
+			PartitionKey: o.Object.Key,
+		}
+	}
+	close(entries)
+}
+
+// delayed is a parser that emits two records for each object after a delay
+type delayed time.Duration
+
+func (d delayed) Parse(objects chan *replay.Object, entries chan *kinesis.PutRecordsRequestEntry) {
+	for o := range objects {
+		o.Body.Close()
+		time.Sleep(time.Duration(d))
+		for i := 0; i < 2; i++ {
+			entries <- &kinesis.PutRecordsRequestEntry{
+				Data:         []byte(fmt.Sprint(i)),
+				PartitionKey: o.Object.Key,
+			}
+		}
+	}
+	close(entries)
+}
+
+func TestParse(t *testing.T) {
+	config := NewRouterConfig()
+	config.Routes = []*Route{
+		{Name: "csv", ContentType: "text/csv", Parser: echo("csv")},
+		{Name: "csv", Key: regexp.MustCompile(`\.csv$`), Parser: echo("csv")},
+		{Name: "json", Magic: regexp.MustCompile(`^\s*[\[{]`), Parser: echo("json")},
+	}
+	router, err := NewRouter(config)
+	assert.Nil(t, err)
+
+	objects := make(chan *replay.Object, 4)
+	for _, o := range []struct{ contentType, key, data string }{
+		{"text/csv; charset=utf-8", "a", "1,2"},
+		{"", "b.csv", "3,4"},
+		{"", "c", ` {"a":1}`},
+		{"", "d", "plain"},
+	} {
+		objects <- &replay.Object{
+			Body:        ioutil.NopCloser(bytes.NewBufferString(o.data)),
+			ContentType: o.contentType,
+			Object:      &s3.Object{Key: aws.String(o.key)},
+		}
+	}
+	close(objects)
+
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	go router.Parse(objects, entries)
+	records := []string{}
+	for e := range entries {
+		records = append(records, *e.PartitionKey+"="+string(e.Data))
+	}
+	sort.Strings(records)
+	assert.Equal(t, []string{"a=csv:1,2", "b.csv=csv:3,4", `c=json: {"a":1}`}, records)
+}
+
+func TestParseOrdered(t *testing.T) {
+	// a slow and a fast route, whose records would interleave if parsed
+	// concurrently
+	config := NewRouterConfig()
+	config.Ordered = true
+	config.Routes = []*Route{
+		{Name: "slow", Key: regexp.MustCompile(`^slow`), Parser: delayed(20 * time.Millisecond)},
+		{Name: "fast", Key: regexp.MustCompile(`^fast`), Parser: delayed(0)},
+	}
+	router, err := NewRouter(config)
+	assert.Nil(t, err)
+
+	objects := make(chan *replay.Object, 5)
+	for _, key := range []string{"slow/a", "fast/b", "other/c", "slow/d", "fast/e"} {
+		objects <- &replay.Object{
+			Body:   ioutil.NopCloser(bytes.NewBufferString("")),
+			Object: &s3.Object{Key: aws.String(key)},
+		}
+	}
+	close(objects)
+
+	entries := make(chan *kinesis.PutRecordsRequestEntry)
+	go router.Parse(objects, entries)
+	records := []string{}
+	for e := range entries {
+		records = append(records, *e.PartitionKey+"="+string(e.Data))
+	}
+	assert.Equal(t, []string{
+		"slow/a=0", "slow/a=1",
+		"fast/b=0", "fast/b=1",
+		"slow/d=0", "slow/d=1",
+		"fast/e=0", "fast/e=1",
+	}, records)
+}
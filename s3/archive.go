@@ -3,30 +3,80 @@
 package s3
 
 import (
+	"errors"
 	"io"
+	"math/rand"
+	"s3-kinesis-replay/decompress"
 	"s3-kinesis-replay/replay"
 	"s3-kinesis-replay/validate"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/cenkalti/backoff"
 	"github.com/sirupsen/logrus"
 )
 
-// Archive implements an s3 archive that utilizes an s3 download
-// manager to download objects concurrently
+// Archive implements an s3 archive that streams objects concurrently,
+// optionally using concurrent ranged GETs within large objects
 type Archive struct {
-	bucket      *string
-	concurrency int
-	client      s3iface.S3API
-	downloader  Downloader
-	log         logrus.FieldLogger
-	prefix      *string
-	startAfter  *string
-	stopAt      *string
-	wg          *sync.WaitGroup
+	asOf             time.Time
+	bucket           *string
+	budget           *Budget
+	compression      decompress.Format
+	concurrency      int
+	client           s3iface.S3API
+	filter           *filter
+	from             time.Time
+	inventoryBucket  *string
+	inventoryKey     *string
+	keys             []string
+	listConcurrency  int
+	log              logrus.FieldLogger
+	maxAttempts      int
+	mu               *sync.Mutex
+	ordered          bool
+	partConcurrency  int
+	partSize         int64
+	prefix           *string
+	prefixes         []*string
+	queued           map[*s3.Object]*slot
+	reporter         replay.Reporter
+	requestPayer     *string
+	restoreDays      int64
+	restoreInterval  time.Duration
+	restoreMaxWait   time.Duration
+	restoreMode      string
+	restores         int
+	restoreTier      string
+	retryInterval    time.Duration
+	retryMaxInterval time.Duration
+	sampled          int
+	sampleEvery      int
+	samplePercent    float64
+	sampleRand       *rand.Rand
+	source           string
+	slots            chan *slot
+	sseCustomerKey   *string
+	startAfter       *string
+	stopAt           *string
+	stopAtMode       string
+	to               time.Time
+	tracker          replay.Tracker
+	versions         map[*s3.Object]*string
+	wg               *sync.WaitGroup
+}
+
+// slot reserves an object's position in scan order, receiving the opened
+// object, or nil if it could not be downloaded, once its download completes
+type slot struct {
+	object   chan *replay.Object
+	reserved int64
 }
 
 // NewArchive returns a new s3 archive
@@ -38,14 +88,52 @@ func NewArchive(c *ArchiveConfig) (*Archive, error) {
 	}
 	// create new archiver
 	a := &Archive{
-		bucket:      aws.String(c.Bucket),
-		client:      c.Client,
-		concurrency: c.Concurrency,
-		downloader:  c.Downloader,
-		log:         c.Log,
-		wg:          &sync.WaitGroup{},
+		asOf:             c.AsOf,
+		bucket:           aws.String(c.Bucket),
+		budget:           c.Budget,
+		client:           c.Client,
+		compression:      decompress.Format(c.Compression),
+		concurrency:      c.Concurrency,
+		keys:             c.Keys,
+		listConcurrency:  c.ListConcurrency,
+		log:              c.Log,
+		maxAttempts:      c.MaxAttempts,
+		mu:               &sync.Mutex{},
+		ordered:          c.Ordered,
+		partConcurrency:  c.PartConcurrency,
+		partSize:         c.PartSize,
+		queued:           make(map[*s3.Object]*slot),
+		reporter:         c.Reporter,
+		restoreDays:      c.RestoreDays,
+		restoreInterval:  c.RestoreInterval,
+		restoreMaxWait:   c.RestoreMaxWait,
+		restoreMode:      c.Restore,
+		restoreTier:      c.RestoreTier,
+		retryInterval:    c.RetryInterval,
+		retryMaxInterval: c.RetryMaxInterval,
+		sampleEvery:      c.SampleEvery,
+		samplePercent:    c.SamplePercent,
+		sampleRand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		source:           c.Source,
+		stopAtMode:       c.StopAtMode,
+		tracker:          c.Tracker,
+		versions:         make(map[*s3.Object]*string),
+		wg:               &sync.WaitGroup{},
+	}
+	// identify the archive source by its location if not named explicitly
+	if a.source == "" {
+		a.source = SourceID(c.Bucket, c.Prefix)
+	}
+	// compile key filters
+	if a.filter, err = newFilter(c); err != nil {
+		return nil, err
 	}
 	// add optional parameters if valid
+	if a.compression == "" {
+		a.compression = decompress.Auto
+	} else if !a.compression.Valid() {
+		return nil, errors.New("invalid compression format: " + c.Compression)
+	}
 	if c.Prefix != "" {
 		a.prefix = aws.String(c.Prefix)
 	}
@@ -55,17 +143,86 @@ func NewArchive(c *ArchiveConfig) (*Archive, error) {
 	if c.StopAt != "" {
 		a.stopAt = aws.String(c.StopAt)
 	}
+	if !replay.ValidStopMode(c.StopAtMode) {
+		return nil, errors.New("invalid stop at mode: " + c.StopAtMode)
+	}
+	if c.RequestPayer {
+		a.requestPayer = aws.String(s3.RequestPayerRequester)
+	}
+	if c.SSECustomerKey != "" {
+		if len(c.SSECustomerKey) != 32 {
+			return nil, errors.New("sse customer key must be 32 bytes")
+		}
+		a.sseCustomerKey = aws.String(c.SSECustomerKey)
+	}
+	if c.ExpectedBucketOwner != "" {
+		client, ok := c.Client.(*s3.S3)
+		if !ok {
+			return nil, errors.New("expected bucket owner requires an s3 client")
+		}
+		client.Handlers.Build.PushBack(expectBucketOwner(c.Bucket, c.ExpectedBucketOwner))
+	}
+	switch c.Restore {
+	case "", RestoreOnly, RestoreWait:
+	default:
+		return nil, errors.New("invalid restore mode: " + c.Restore)
+	}
+	if c.Restore != "" {
+		if !tiers[c.RestoreTier] {
+			return nil, errors.New("invalid restore tier: " + c.RestoreTier)
+		}
+		if c.RestoreDays < 1 || c.RestoreInterval <= 0 || c.RestoreMaxWait <= 0 {
+			return nil, errors.New("restore days, interval and maximum wait must be positive")
+		}
+	}
+	if !c.AsOf.IsZero() && (c.Inventory != "" || len(c.Keys) > 0) {
+		return nil, errors.New("as of time cannot be used with an inventory or keys")
+	}
+	if c.Inventory != "" {
+		bucket, key, err := ParseInventory(c.Inventory)
+		if err != nil {
+			return nil, err
+		}
+		a.inventoryBucket = aws.String(bucket)
+		a.inventoryKey = aws.String(key)
+	}
+	// expand time range into date-partitioned prefixes
+	if !c.From.IsZero() {
+		a.from = c.From
+		a.to = c.To
+		if a.to.IsZero() {
+			a.to = time.Now()
+		}
+		if !a.from.Before(a.to) {
+			return nil, errors.New("time range start must be before end")
+		}
+		for _, prefix := range TimePrefixes(c.Prefix, c.KeyTemplate, a.from, a.to) {
+			a.prefixes = append(a.prefixes, aws.String(prefix))
+		}
+	}
 	return a, nil
 }
 
+// SourceID returns the default identifier of an archive source
+func SourceID(bucket, prefix string) string {
+	return "s3://" + bucket + "/" + prefix
+}
+
 // Scan implements logic for scanning some or all of an s3 message
-// archive, downloading archive objects concurrently, and emitting
+// archive, opening archive object streams concurrently, and emitting
 // them the returned channel
 func (a *Archive) Scan() chan *replay.Object {
 	// create buffered channel to queue s3 objects for downloading
 	pending := make(chan *s3.Object, 1000)
-	// create buffered channel to emit downloaded s3 objects
-	objects := make(chan *replay.Object, 1000)
+	// create buffered channel to emit opened s3 objects, limited to the
+	// download concurrency as each object holds an open stream
+	objects := make(chan *replay.Object, a.concurrency)
+	// in ordered mode, reserve a slot for each queued object, limited to the
+	// download concurrency so that only a few objects are downloaded ahead
+	// of the next object in order
+	if a.ordered {
+		a.slots = make(chan *slot, a.concurrency)
+	}
 	// start download workers
 	for i := 0; i < a.concurrency; i++ {
 		a.wg.Add(1)
@@ -73,104 +230,594 @@ func (a *Archive) Scan() chan *replay.Object {
 	}
 	// start archive scan
 	go a.scan(pending)
-	// add handler to close objects channel after all objects have
-	// been downloaded
-	go func() {
-		a.wg.Wait()
-		close(objects)
-	}()
+	// emit objects in scan order, or add handler to close objects channel
+	// after all objects have been downloaded
+	if a.ordered {
+		go a.reorder(objects)
+	} else {
+		go func() {
+			a.wg.Wait()
+			close(objects)
+		}()
+	}
 	return objects
 }
 
-// scan recursively scans an s3 bucket/prefix/startAfter and queues
-// returned objects, stopping either when the specified
-// stop at key is found or all objects have been downloaded
-func (a *Archive) scan(pending chan *s3.Object) {
-	// define list object parameters
-	params := &s3.ListObjectsV2Input{
-		Bucket:     a.bucket,
-		Prefix:     a.prefix,
-		StartAfter: a.startAfter,
-	}
-	// scan through object pages
-	err := a.client.ListObjectsV2Pages(params, func(output *s3.ListObjectsV2Output, more bool) bool {
-		for _, o := range output.Contents {
-			if a.stopAt != nil && *a.stopAt == *o.Key {
-				a.log.WithField("key", *o.Key).Infoln("stopping at stop key")
-				return false
-			}
-			a.log.WithField("key", *o.Key).Debugln("queueing s3 key for download")
-			pending <- o
+// reorder emits downloaded objects in the order they were queued, buffering
+// objects whose downloads complete ahead of those queued before them
+func (a *Archive) reorder(objects chan *replay.Object) {
+	for s := range a.slots {
+		if o := <-s.object; o != nil {
+			objects <- o
 		}
-		return true
-	})
+	}
+	close(objects)
+}
+
+// scan scans an s3 bucket/prefix/startAfter, or its object versions, or reads
+// its inventory or an explicit list of keys, and queues returned objects,
+// stopping either when the specified stop at key is found or all objects have
+// been downloaded
+func (a *Archive) scan(pending chan *s3.Object) {
+	a.checkStop()
+	var err error
+	if len(a.keys) > 0 {
+		err = a.scanKeys(pending)
+	} else if a.inventoryKey != nil {
+		err = a.scanInventory(pending)
+	} else if !a.asOf.IsZero() {
+		err = a.scanVersions(pending)
+	} else {
+		err = a.scanList(pending)
+	}
 	if err != nil {
 		a.log.WithError(err).Errorln("scan:error")
 	} else {
 		a.log.Infoln("scan complete")
 	}
+	if a.restoreMode == RestoreOnly {
+		a.log.WithField("restores", a.restores).Infoln("restores initiated")
+	}
 	close(pending)
+	if a.slots != nil {
+		close(a.slots)
+	}
+}
+
+// checkStop warns if the stop at key bounds the keys to scan such that no
+// keys can be replayed, or such that it can never be reached
+func (a *Archive) checkStop() {
+	if a.stopAt == nil {
+		return
+	}
+	prefixes := a.scanPrefixes()
+	first, last := aws.StringValue(prefixes[0]), aws.StringValue(prefixes[len(prefixes)-1])
+	// the lowest key that could be scanned is the first prefix itself, or the
+	// key immediately following the start key
+	lowest := first
+	if a.startAfter != nil && *a.startAfter+"\x00" > lowest {
+		lowest = *a.startAfter + "\x00"
+	}
+	log := a.log.WithFields(logrus.Fields{
+		"mode":   a.stopAtMode,
+		"prefix": aws.StringValue(a.prefix),
+		"stopAt": *a.stopAt,
+	})
+	if replay.StopReached(lowest, *a.stopAt, a.stopAtMode) {
+		log.Warnln("stop at key precedes all keys to scan, nothing will be replayed")
+	} else if *a.stopAt > last && !strings.HasPrefix(*a.stopAt, last) {
+		log.Warnln("stop at key follows all keys under the prefix and will never be reached")
+	}
+}
+
+// scanList recursively lists the configured prefixes and queues returned
+// objects
+func (a *Archive) scanList(pending chan *s3.Object) error {
+	if a.listConcurrency > 1 {
+		return a.scanListConcurrent(pending)
+	}
+	stopped := false
+	for _, prefix := range a.scanPrefixes() {
+		// define list object parameters
+		params := &s3.ListObjectsV2Input{
+			Bucket:       a.bucket,
+			Prefix:       prefix,
+			RequestPayer: a.requestPayer,
+			StartAfter:   a.startAfter,
+		}
+		// scan through object pages
+		err := a.client.ListObjectsV2Pages(params, func(output *s3.ListObjectsV2Output, more bool) bool {
+			for _, o := range output.Contents {
+				if !a.queue(o, nil, pending) {
+					stopped = true
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			break
+		}
+	}
+	return nil
+}
+
+// scanPrefixes returns each time range prefix in order, or the single
+// configured prefix
+func (a *Archive) scanPrefixes() []*string {
+	if len(a.prefixes) == 0 {
+		return []*string{a.prefix}
+	}
+	return a.prefixes
+}
+
+// queue queues a listed object, or a specific version of it, for download if
+// it satisfies the time range and filter rules, returning false if the stop
+// at key has been reached
+func (a *Archive) queue(o *s3.Object, versionID *string, pending chan *s3.Object) bool {
+	if a.stopAt != nil && replay.StopReached(*o.Key, *a.stopAt, a.stopAtMode) {
+		a.log.WithField("key", *o.Key).Infoln("stopping at stop key")
+		return false
+	}
+	if !a.inRange(o) {
+		a.log.WithField("key", *o.Key).Debugln("skipping s3 key outside of time range")
+		return true
+	}
+	if a.filter != nil && !a.filter.match(o) {
+		a.log.WithField("key", *o.Key).Debugln("skipping filtered s3 key")
+		return true
+	}
+	if !a.sample() {
+		a.log.WithField("key", *o.Key).Debugln("skipping unsampled s3 key")
+		return true
+	}
+	if versionID != nil {
+		a.mu.Lock()
+		a.versions[o] = versionID
+		a.mu.Unlock()
+	}
+	// initiate restores of archived objects ahead of their download, failing
+	// objects whose restore cannot be initiated
+	if a.restoreMode != "" && archived(o) {
+		if err := a.restore(o); err != nil {
+			a.fail(o, errors.New("error initiating restore: "+err.Error()))
+			return true
+		}
+		a.restores++
+	}
+	if a.restoreMode == RestoreOnly {
+		if versionID != nil {
+			a.forget(o)
+		}
+		return true
+	}
+	a.log.WithField("key", *o.Key).Debugln("queueing s3 key for download")
+	if a.tracker != nil {
+		a.tracker.Object(a.source, *o.Key)
+	}
+	if a.slots != nil {
+		a.reserve(o)
+	}
+	pending <- o
+	return true
+}
+
+// reserve reserves the next slot in scan order for an object. Its share of
+// the in-flight byte budget is acquired here rather than by the worker, so
+// that objects acquire the budget in the order they will be emitted and a
+// later object cannot hold the budget needed by an earlier one.
+func (a *Archive) reserve(o *s3.Object) {
+	s := &slot{object: make(chan *replay.Object, 1)}
+	if a.budget != nil {
+		s.reserved = a.budget.acquire(a, *o.Key, aws.Int64Value(o.Size))
+	}
+	a.mu.Lock()
+	a.queued[o] = s
+	a.mu.Unlock()
+	a.slots <- s
+}
+
+// slot returns and forgets the slot reserved for an object, if any
+func (a *Archive) slot(o *s3.Object) *slot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.queued[o]
+	delete(a.queued, o)
+	return s
+}
+
+// sample determines whether the next object that satisfies the time range
+// and filter rules is included in the configured sample, keeping every Nth
+// object and then a random percentage of those
+func (a *Archive) sample() bool {
+	if a.sampleEvery > 1 {
+		a.sampled++
+		if (a.sampled-1)%a.sampleEvery != 0 {
+			return false
+		}
+	}
+	if a.samplePercent > 0 && a.samplePercent < 100 {
+		return a.sampleRand.Float64()*100 < a.samplePercent
+	}
+	return true
+}
+
+// inRange determines whether an object's firehose delivery timestamp, if
+// present in its key, falls within the configured time range
+func (a *Archive) inRange(o *s3.Object) bool {
+	if a.from.IsZero() {
+		return true
+	}
+	t, ok := keyTime(*o.Key)
+	if !ok {
+		return true
+	}
+	return !t.Before(a.from) && t.Before(a.to)
 }
 
-// worker manages downloading pending s3 objects
+// worker manages opening pending s3 objects for streaming, retrying failed
+// downloads with exponential backoff
 func (a *Archive) worker(wg *sync.WaitGroup, pending chan *s3.Object, objects chan *replay.Object) {
 	for o := range pending {
-		buff := &aws.WriteAtBuffer{}
-		// download object
-		n, err := a.downloader.Download(buff, &s3.GetObjectInput{
-			Bucket: a.bucket,
-			Key:    o.Key,
+		// look up the object's slot in ordered mode, which holds its share
+		// of the in-flight byte budget
+		var s *slot
+		if a.ordered {
+			s = a.slot(o)
+		}
+		// wait for archived objects to be restored
+		if a.restoreMode == RestoreWait && archived(o) {
+			if err := a.waitRestored(o); err != nil {
+				if s != nil {
+					a.skip(s)
+				}
+				a.fail(o, err)
+				continue
+			}
+		}
+		// wait for the object to fit within the in-flight byte budget
+		var reserved int64
+		if s != nil {
+			reserved = s.reserved
+		} else if a.budget != nil {
+			reserved = a.budget.acquire(a, *o.Key, aws.Int64Value(o.Size))
+		}
+		// open object stream, retrying failed attempts
+		var body io.ReadCloser
+		var contentType string
+		err := backoff.RetryNotify(func() error {
+			var err error
+			body, contentType, err = a.open(o)
+			if aerr := archivedError(err); aerr != nil {
+				return backoff.Permanent(aerr)
+			}
+			return err
+		}, a.retryPolicy(), func(err error, wait time.Duration) {
+			a.log.WithError(err).WithFields(logrus.Fields{
+				"key":  *o.Key,
+				"wait": wait,
+			}).Warnln("download error, retrying")
 		})
-		// on error, requeue object and kill worker
+		// on failure, report object and move on to the next
 		if err != nil {
-			a.log.WithError(err).Errorln("download error")
-			pending <- o
-			break
+			if s != nil {
+				a.skip(s)
+			} else if a.budget != nil {
+				a.budget.release(a, reserved)
+			}
+			a.fail(o, err)
+			continue
+		}
+		if !a.asOf.IsZero() {
+			a.forget(o)
 		}
 		// log download info
-		a.log.WithFields(logrus.Fields{
-			"n":   n,
-			"key": o.Key,
-		}).Debugln("download complete")
-		// emit processed object
-		objects <- &replay.Object{
-			Data:   buff.Bytes(),
+		fields := logrus.Fields{
+			"size": aws.Int64Value(o.Size),
+			"key":  o.Key,
+		}
+		// release the object's bytes once the parser closes its stream
+		if a.budget != nil {
+			body = &readCloser{
+				Reader:  body,
+				closers: []io.Closer{body, &budgetCloser{archive: a, budget: a.budget, n: reserved, once: &sync.Once{}}},
+			}
+			fields["inflight"] = a.budget.Used()
+		}
+		a.log.WithFields(fields).Debugln("download started")
+		// emit streaming object, or hand it to its slot in ordered mode
+		// report objects whose stream fails while being parsed, such as a
+		// connection reset or decompression error, like failed downloads
+		object := &replay.Object{
+			Body:        body,
+			ContentType: contentType,
+			Fail: func(err error) {
+				a.fail(o, err)
+			},
 			Object: o,
+			Source: a.source,
+		}
+		if s != nil {
+			s.object <- object
+		} else {
+			objects <- object
 		}
 	}
 	wg.Done()
 }
 
+// skip releases the slot and in-flight bytes reserved for an object that
+// could not be downloaded in ordered mode
+func (a *Archive) skip(s *slot) {
+	if a.budget != nil {
+		a.budget.release(a, s.reserved)
+	}
+	s.object <- nil
+}
+
+// fail logs and reports an object that could not be downloaded or read
+func (a *Archive) fail(o *s3.Object, err error) {
+	if !a.asOf.IsZero() {
+		a.forget(o)
+	}
+	a.log.WithError(err).WithField("key", *o.Key).Errorln("download failed")
+	if a.reporter != nil {
+		a.reporter.Failed(*a.bucket, *o.Key, err)
+	}
+}
+
+// retryPolicy returns a new exponential backoff policy limited to the maximum
+// number of download attempts per object
+func (a *Archive) retryPolicy() backoff.BackOff {
+	// a maximum of zero retries would be treated as unlimited
+	if a.maxAttempts <= 1 {
+		return &backoff.StopBackOff{}
+	}
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = a.retryInterval
+	b.MaxInterval = a.retryMaxInterval
+	b.MaxElapsedTime = 0
+	return backoff.WithMaxTries(b, uint64(a.maxAttempts-1))
+}
+
+// open begins downloading an object, using concurrent ranged GETs if the
+// object spans multiple parts, and returns a decompressing stream of its data
+// along with its content type
+func (a *Archive) open(o *s3.Object) (io.ReadCloser, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       a.bucket,
+		IfMatch:      o.ETag,
+		Key:          o.Key,
+		RequestPayer: a.requestPayer,
+	}
+	if a.sseCustomerKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = a.sseCustomerKey
+	}
+	if !a.asOf.IsZero() {
+		input.VersionId = a.version(o)
+	}
+	var body io.ReadCloser
+	var output *s3.GetObjectOutput
+	var err error
+	if size := aws.Int64Value(o.Size); a.partConcurrency > 1 && size > a.partSize {
+		body, output, err = newRangeReader(a.client, input, size, a.partSize, a.partConcurrency, a.retryPolicy, func(err error, wait time.Duration) {
+			a.log.WithError(err).WithFields(logrus.Fields{
+				"key":  *o.Key,
+				"wait": wait,
+			}).Warnln("part download error, retrying")
+		})
+	} else {
+		output, err = a.client.GetObject(input)
+		if err == nil {
+			body = output.Body
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := a.decompress(*o.Key, aws.StringValue(output.ContentEncoding), body)
+	if err != nil {
+		body.Close()
+		return nil, "", err
+	}
+	return r, aws.StringValue(output.ContentType), nil
+}
+
+// headObject reads the metadata of an object, or a specific version of it
+func (a *Archive) headObject(key, versionID *string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       a.bucket,
+		Key:          key,
+		RequestPayer: a.requestPayer,
+		VersionId:    versionID,
+	}
+	if a.sseCustomerKey != nil {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = a.sseCustomerKey
+	}
+	return a.client.HeadObject(input)
+}
+
+// expectBucketOwner returns a request handler that adds the expected bucket
+// owner header to requests for the given bucket, which this sdk version does
+// not model as an input field, so that s3 rejects them if the bucket is owned
+// by another account
+func expectBucketOwner(bucket, owner string) func(*request.Request) {
+	return func(r *request.Request) {
+		values, err := awsutil.ValuesAtPath(r.Params, "Bucket")
+		if err != nil || len(values) == 0 {
+			return
+		}
+		if b, ok := values[0].(*string); ok && aws.StringValue(b) == bucket {
+			r.HTTPRequest.Header.Set("X-Amz-Expected-Bucket-Owner", owner)
+		}
+	}
+}
+
+// decompress wraps an object stream with a decompressing reader using the
+// configured compression format, detecting the format if necessary
+func (a *Archive) decompress(key, encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	r, format, err := decompress.Open(a.compression, encoding, key, body)
+	if err != nil {
+		return nil, err
+	}
+	if format != decompress.None {
+		a.log.WithFields(logrus.Fields{
+			"format": format,
+			"key":    key,
+		}).Debugln("decompressing object")
+	}
+	return &readCloser{Reader: r, closers: []io.Closer{r, body}}, nil
+}
+
+// readCloser is a reader that closes a chain of underlying streams
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes each of the underlying streams, returning the first error
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // ArchiveConfig defines an archive configuration
 type ArchiveConfig struct {
+	// An optional point in time, which replays the version of each object
+	// that was current at that time from a versioned bucket
+	AsOf time.Time `validate:"-"`
 	// The S3 bucket that contains the archive
 	Bucket string `validate:"required"`
+	// An optional budget limiting the bytes of objects that have been opened
+	// for download but not yet consumed by the parser
+	Budget *Budget `validate:"-"`
 	// A configured s3 client
 	Client s3iface.S3API `validate:"required"`
+	// An optional compression format override, defaults to detecting the
+	// format of each object
+	Compression string `validate:"-"`
 	// Number of objects to download in parallel
 	Concurrency int `validate:"required,min=1"`
-	// A configured s3 download manager
-	Downloader Downloader `validate:"required"`
+	// An optional account id that must own the bucket, rejecting requests if
+	// the bucket is owned by another account
+	ExpectedBucketOwner string `validate:"-"`
+	// Optional regular expressions, of which an object key must match none
+	Exclude []string `validate:"-"`
+	// Optional glob patterns, of which an object key must match none
+	ExcludeGlob []string `validate:"-"`
+	// An optional time range start, which limits the scan to the
+	// date-partitioned prefixes that fall within the time range
+	From time.Time `validate:"-"`
+	// Optional regular expressions, of which an object key must match at
+	// least one if any include rules are defined
+	Include []string `validate:"-"`
+	// Optional glob patterns, of which an object key must match at least one
+	// if any include rules are defined
+	IncludeGlob []string `validate:"-"`
+	// An optional s3://<bucket>/<key> location of an s3 inventory
+	// manifest.json to read the archive's objects from instead of listing
+	// the bucket
+	Inventory string `validate:"-"`
+	// An optional time layout describing the date-partitioned portion of
+	// archive keys, defaults to the firehose YYYY/MM/DD/HH/ layout
+	KeyTemplate string `validate:"-"`
+	// An optional explicit list of keys to replay instead of listing the
+	// bucket
+	Keys []string `validate:"-"`
+	// Number of prefixes to list in parallel, a value of 1 lists the archive
+	// with a single cursor
+	ListConcurrency int `validate:"-"`
 	// An optional archive scoped logger
 	Log logrus.FieldLogger `valdiate:"required"`
+	// Maximum number of attempts to download each object
+	MaxAttempts int `validate:"required,min=1"`
+	// An optional maximum object size in bytes
+	MaxSize int64 `validate:"-"`
+	// An optional minimum object size in bytes
+	MinSize int64 `validate:"-"`
+	// An optional time at or after which objects must have been last modified
+	ModifiedAfter time.Time `validate:"-"`
+	// An optional time before which objects must have been last modified
+	ModifiedBefore time.Time `validate:"-"`
+	// Whether to emit objects in scan order regardless of the order in which
+	// their concurrent downloads complete
+	Ordered bool `validate:"-"`
+	// Number of ranged GETs to download or buffer ahead of the reader for
+	// each object, a value of 1 streams each object with a single GET
+	PartConcurrency int `validate:"required,min=1"`
+	// Size in bytes of each ranged GET for objects that span multiple parts
+	PartSize int64 `validate:"required,min=1"`
 	// An optional prefix that contains the relevant archive portion
 	Prefix string `validate:"-"`
+	// An optional reporter to notify of objects that could not be downloaded
+	Reporter replay.Reporter `validate:"-"`
+	// Whether to accept requester pays charges for the bucket
+	RequestPayer bool `validate:"-"`
+	// An optional restore mode for objects in the GLACIER or DEEP_ARCHIVE
+	// storage classes, either wait or only
+	Restore string `validate:"-"`
+	// Number of days restored objects remain available
+	RestoreDays int64 `validate:"-"`
+	// Interval between checks of whether a restore has completed
+	RestoreInterval time.Duration `validate:"-"`
+	// Maximum time to wait for an object's restore to complete before the
+	// object fails
+	RestoreMaxWait time.Duration `validate:"-"`
+	// The restore retrieval tier, one of Standard, Bulk or Expedited
+	RestoreTier string `validate:"-"`
+	// Initial interval between download attempts of an object
+	RetryInterval time.Duration `validate:"required"`
+	// Maximum interval between download attempts of an object
+	RetryMaxInterval time.Duration `validate:"required"`
+	// An optional sampling interval, which replays only every Nth object
+	SampleEvery int `validate:"min=0"`
+	// An optional percentage of objects to replay, chosen at random
+	SamplePercent float64 `validate:"min=0,max=100"`
+	// An optional identifier for the archive source, used to distinguish the
+	// progress of multiple sources, defaults to s3://<bucket>/<prefix>
+	Source string `validate:"-"`
+	// An optional 256-bit customer provided key for objects encrypted with
+	// SSE-C
+	SSECustomerKey string `validate:"-"`
 	// An optional s3 key to begin replay after
 	StartAfter string `validate:"-"`
-	// An optional s3 key to stop replay at
+	// An optional upper bound on the s3 keys to replay
 	StopAt string `validate:"-"`
+	// An optional mode determining how the stop at key bounds the keys to
+	// replay, one of exclusive (default), inclusive or prefix
+	StopAtMode string `validate:"-"`
+	// An optional time range end, defaults to now if a time range
+	// start is specified
+	To time.Time `validate:"-"`
+	// An optional tracker to notify of queued objects
+	Tracker replay.Tracker `validate:"-"`
 }
 
 // NewArchiveConfig returns an archive config value with appropriate
 // defaults
 func NewArchiveConfig() *ArchiveConfig {
 	return &ArchiveConfig{
-		Concurrency: 10,
-		Log:         logrus.WithField("package", "s3"),
+		Concurrency:      10,
+		ListConcurrency:  1,
+		Log:              logrus.WithField("package", "s3"),
+		MaxAttempts:      5,
+		PartConcurrency:  1,
+		PartSize:         1024 * 1024 * 8,
+		RestoreDays:      1,
+		RestoreInterval:  time.Minute,
+		RestoreMaxWait:   48 * time.Hour,
+		RestoreTier:      s3.TierStandard,
+		RetryInterval:    time.Second,
+		RetryMaxInterval: time.Second * 30,
 	}
 }
-
-// Downloader represents an s3 download manager
-type Downloader interface {
-	Download(io.WriterAt, *s3.GetObjectInput, ...func(*s3manager.Downloader)) (int64, error)
-}
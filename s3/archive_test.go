@@ -1,15 +1,28 @@
 package s3
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"s3-kinesis-replay/mock"
 	"s3-kinesis-replay/replay"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	mocks "github.com/stretchr/testify/mock"
 )
@@ -21,21 +34,29 @@ func TestNewArchiveInvalidConfig(t *testing.T) {
 	}{
 		{true, NewArchiveConfig()},
 		{true, &ArchiveConfig{
-			Bucket:      "test",
-			Client:      &mock.S3API{},
-			Concurrency: 0,
-			Downloader:  &mock.Downloader{},
-			Log:         logrus.WithField("test", true),
+			Bucket:           "test",
+			Client:           &mock.S3API{},
+			Concurrency:      0,
+			Log:              logrus.WithField("test", true),
+			MaxAttempts:      1,
+			PartConcurrency:  1,
+			PartSize:         1024,
+			RetryInterval:    time.Second,
+			RetryMaxInterval: time.Second,
 		}},
 		{false, &ArchiveConfig{
-			Bucket:      "test",
-			Client:      &mock.S3API{},
-			Concurrency: 1,
-			Downloader:  &mock.Downloader{},
-			Log:         logrus.WithField("test", true),
-			Prefix:      "foo",
-			StartAfter:  "b",
-			StopAt:      "d",
+			Bucket:           "test",
+			Client:           &mock.S3API{},
+			Concurrency:      1,
+			Log:              logrus.WithField("test", true),
+			MaxAttempts:      1,
+			PartConcurrency:  1,
+			PartSize:         1024,
+			RetryInterval:    time.Second,
+			RetryMaxInterval: time.Second,
+			Prefix:           "foo",
+			StartAfter:       "b",
+			StopAt:           "d",
 		}},
 	}
 	for _, testcase := range testcases {
@@ -116,24 +137,28 @@ func TestScanStopAt(t *testing.T) {
 }
 
 func TestWorkerDownloadError(t *testing.T) {
-	// create mock downloader
-	downloader := &mock.Downloader{}
-	downloader.On("Download", mocks.Anything, mocks.Anything).Return(int64(0), errors.New("unexpected")).Once()
-	downloader.On("Download", mocks.Anything, mocks.Anything).Return(int64(1000), nil).Once()
+	// create mock s3 client
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.Anything).Return(nil, errors.New("unexpected")).Once()
+	client.On("GetObject", mocks.Anything).Return(&s3.GetObjectOutput{
+		Body: ioutil.NopCloser(strings.NewReader("{}")),
+	}, nil).Once()
 
-	// create archive using mock downloader
+	// create archive using mock s3 client
 	archive := &Archive{
-		bucket:     aws.String("test"),
-		downloader: downloader,
-		log:        logrus.WithField("test", true),
+		bucket:           aws.String("test"),
+		client:           client,
+		log:              logrus.WithField("test", true),
+		maxAttempts:      2,
+		retryInterval:    time.Millisecond,
+		retryMaxInterval: time.Millisecond,
 	}
 	// create worker arguments
 	wg := &sync.WaitGroup{}
 	pending := make(chan *s3.Object, 2)
 	objects := make(chan *replay.Object, 2)
-	// start two workers
-	wg.Add(2)
-	go archive.worker(wg, pending, objects)
+	// start a single worker, which must retry the object itself
+	wg.Add(1)
 	go archive.worker(wg, pending, objects)
 	// commit an s3 object to the worker queue
 	pending <- &s3.Object{
@@ -141,5 +166,937 @@ func TestWorkerDownloadError(t *testing.T) {
 	}
 	object := <-objects
 	assert.Equal(t, "foo", *object.Object.Key)
-	downloader.AssertExpectations(t)
+	client.AssertExpectations(t)
+}
+
+func TestWorkerDownloadFailed(t *testing.T) {
+	// create mock s3 client that fails to download one object, and whose other
+	// object fails partway through its body
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.MatchedBy(func(in *s3.GetObjectInput) bool {
+		return *in.Key == "foo"
+	})).Return(nil, errors.New("unexpected")).Times(3)
+	client.On("GetObject", mocks.MatchedBy(func(in *s3.GetObjectInput) bool {
+		return *in.Key == "bar"
+	})).Return(&s3.GetObjectOutput{
+		Body: ioutil.NopCloser(&failingReader{data: bytes.Repeat([]byte("{}\n"), 100), err: errors.New("connection reset")}),
+	}, nil).Once()
+
+	// create archive that reports failed objects
+	dir, err := ioutil.TempDir("", "report")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	reportConfig := NewReportConfig()
+	reportConfig.File = filepath.Join(dir, "failed.csv")
+	report, err := NewReport(reportConfig)
+	assert.Nil(t, err)
+	archive := &Archive{
+		bucket:           aws.String("test"),
+		client:           client,
+		log:              logrus.WithField("test", true),
+		maxAttempts:      3,
+		reporter:         report,
+		retryInterval:    time.Millisecond,
+		retryMaxInterval: time.Millisecond,
+	}
+
+	// the worker must survive the failed object and close when done
+	wg := &sync.WaitGroup{}
+	pending := make(chan *s3.Object, 2)
+	objects := make(chan *replay.Object, 2)
+	wg.Add(1)
+	go archive.worker(wg, pending, objects)
+	pending <- &s3.Object{Key: aws.String("foo")}
+	pending <- &s3.Object{Key: aws.String("bar")}
+	close(pending)
+	wg.Wait()
+	close(objects)
+	keys := []string{}
+	for o := range objects {
+		keys = append(keys, *o.Object.Key)
+		// parsers fail objects whose body cannot be fully read
+		if _, err := ioutil.ReadAll(o.Body); err != nil {
+			o.Fail(err)
+		}
+		o.Body.Close()
+	}
+	assert.Equal(t, []string{"bar"}, keys)
+	client.AssertExpectations(t)
+
+	// the report can be replayed as a keys file
+	assert.Nil(t, report.Close())
+	f, err := os.Open(reportConfig.File)
+	assert.Nil(t, err)
+	defer f.Close()
+	failed, _, err := ReadKeys(f, "test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, failed)
+}
+
+func TestOpenRanged(t *testing.T) {
+	// create mock s3 client that serves ranged GETs of a gzip'd object
+	gz := &bytes.Buffer{}
+	w := gzip.NewWriter(gz)
+	w.Write([]byte(strings.Repeat(`{"foo":"bar"}`, 100)))
+	w.Close()
+	data := gz.Bytes()
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+			var start, end int
+			fmt.Sscanf(*in.Range, "bytes=%d-%d", &start, &end)
+			return &s3.GetObjectOutput{
+				Body: ioutil.NopCloser(bytes.NewReader(data[start : end+1])),
+			}
+		}, nil)
+
+	// create archive using small parts
+	archive := &Archive{
+		bucket:          aws.String("test"),
+		client:          client,
+		log:             logrus.WithField("test", true),
+		partConcurrency: 3,
+		partSize:        7,
+	}
+	body, _, err := archive.open(&s3.Object{
+		Key:  aws.String("foo"),
+		Size: aws.Int64(int64(len(data))),
+	})
+	assert.Nil(t, err)
+	b, err := ioutil.ReadAll(body)
+	assert.Nil(t, err)
+	assert.Nil(t, body.Close())
+	assert.Equal(t, strings.Repeat(`{"foo":"bar"}`, 100), string(b))
+}
+
+func TestOpenRangedRetry(t *testing.T) {
+	// create mock s3 client whose ranged GETs of the second part fail partway
+	// through their body, once or always
+	data := []byte(strings.Repeat("0123456789", 3))
+	for _, failures := range []int{1, 3} {
+		client := &mock.S3API{}
+		client.On("GetObject", mocks.MatchedBy(func(in *s3.GetObjectInput) bool {
+			return *in.Range == "bytes=10-19"
+		})).Return(&s3.GetObjectOutput{
+			Body: ioutil.NopCloser(&failingReader{data: data[10:13], err: errors.New("connection reset")}),
+		}, nil).Times(failures)
+		client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+			Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+				var start, end int
+				fmt.Sscanf(*in.Range, "bytes=%d-%d", &start, &end)
+				return &s3.GetObjectOutput{
+					Body: ioutil.NopCloser(bytes.NewReader(data[start : end+1])),
+				}
+			}, nil)
+
+		// create archive that attempts each part up to 3 times
+		archive := &Archive{
+			bucket:           aws.String("test"),
+			client:           client,
+			log:              logrus.WithField("test", true),
+			maxAttempts:      3,
+			partConcurrency:  2,
+			partSize:         10,
+			retryInterval:    time.Millisecond,
+			retryMaxInterval: time.Millisecond,
+		}
+		body, _, err := archive.open(&s3.Object{
+			Key:  aws.String("foo"),
+			Size: aws.Int64(int64(len(data))),
+		})
+		assert.Nil(t, err)
+		b, err := ioutil.ReadAll(body)
+		body.Close()
+		if failures < archive.maxAttempts {
+			assert.Nil(t, err)
+			assert.Equal(t, data, b)
+		} else {
+			assert.EqualError(t, err, "connection reset")
+		}
+	}
+}
+
+// failingReader reads its data and then fails, as a body whose connection is
+// reset partway through would
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestTimePrefixes(t *testing.T) {
+	from := time.Date(2018, 1, 3, 4, 0, 0, 0, time.UTC)
+	to := time.Date(2018, 1, 3, 9, 30, 0, 0, time.UTC)
+	prefixes := TimePrefixes("stream/", "", from, to)
+	assert.Equal(t, []string{
+		"stream/2018/01/03/04/",
+		"stream/2018/01/03/05/",
+		"stream/2018/01/03/06/",
+		"stream/2018/01/03/07/",
+		"stream/2018/01/03/08/",
+		"stream/2018/01/03/09/",
+	}, prefixes)
+
+	// coarser templates collapse into distinct prefixes
+	prefixes = TimePrefixes("", "dt=2006-01-02/", from, to.Add(time.Hour*24))
+	assert.Equal(t, []string{"dt=2018-01-03/", "dt=2018-01-04/"}, prefixes)
+}
+
+func TestScanTimeRange(t *testing.T) {
+	// create mock s3 client that returns a page per prefix
+	client := &mock.S3API{}
+	for _, prefix := range []string{"2018/01/03/04/", "2018/01/03/05/"} {
+		hour := prefix[11:13]
+		output := &s3.ListObjectsV2Output{
+			Contents: []*s3.Object{
+				&s3.Object{Key: aws.String(prefix + "s-1-2018-01-03-" + hour + "-10-00-a")},
+				&s3.Object{Key: aws.String(prefix + "s-1-2018-01-03-" + hour + "-40-00-b")},
+			},
+		}
+		client.On("ListObjectsV2Pages", mocks.MatchedBy(func(in *s3.ListObjectsV2Input) bool {
+			return *in.Prefix == prefix
+		}), mocks.AnythingOfType("func(*s3.ListObjectsV2Output, bool) bool")).
+			Run(func(args mocks.Arguments) {
+				cb := args.Get(1).(func(*s3.ListObjectsV2Output, bool) bool)
+				cb(output, true)
+			}).
+			Return(nil).
+			Once()
+	}
+
+	// create archive for the range 04:30 - 05:30
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.From = time.Date(2018, 1, 3, 4, 30, 0, 0, time.UTC)
+	config.To = time.Date(2018, 1, 3, 5, 30, 0, 0, time.UTC)
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// invoke scan
+	pending := make(chan *s3.Object, 4)
+	archive.scan(pending)
+	keys := []string{}
+	for o := range pending {
+		keys = append(keys, *o.Key)
+	}
+	assert.Equal(t, []string{
+		"2018/01/03/04/s-1-2018-01-03-04-40-00-b",
+		"2018/01/03/05/s-1-2018-01-03-05-10-00-a",
+	}, keys)
+	client.AssertExpectations(t)
+}
+
+func TestFilterMatch(t *testing.T) {
+	config := NewArchiveConfig()
+	config.IncludeGlob = []string{"**/stream-*", "logs/**/x.json"}
+	config.Exclude = []string{`\.manifest$`}
+	config.ExcludeGlob = []string{"processing-failed/**"}
+	config.MinSize = 10
+	config.ModifiedAfter = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, err := newFilter(config)
+	assert.Nil(t, err)
+
+	modified := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	testcases := []*struct {
+		key      string
+		size     int64
+		modified time.Time
+		expected bool
+	}{
+		{"2018/01/02/00/stream-1", 100, modified, true},
+		{"2018/01/02/00/other-1", 100, modified, false},
+		{"processing-failed/2018/01/02/00/stream-1", 100, modified, false},
+		{"2018/01/02/00/stream-1.manifest", 100, modified, false},
+		{"2018/01/02/00/stream-1", 1, modified, false},
+		{"2018/01/02/00/stream-1", 100, modified.AddDate(-1, 0, 0), false},
+		// **/ matches zero or more path segments
+		{"stream-1", 100, modified, true},
+		{"logs/x.json", 100, modified, true},
+		{"logs/a/b/x.json", 100, modified, true},
+		{"logs/ax.json", 100, modified, false},
+	}
+	for _, testcase := range testcases {
+		o := &s3.Object{
+			Key:          aws.String(testcase.key),
+			LastModified: aws.Time(testcase.modified),
+			Size:         aws.Int64(testcase.size),
+		}
+		assert.Equal(t, testcase.expected, f.match(o), testcase.key)
+	}
+}
+
+func TestScanInventoryCSV(t *testing.T) {
+	// create gzip'd inventory files, each sorted by key, whose rows are
+	// interleaved across files
+	files := map[string][]byte{
+		"manifest.json": []byte(`{
+			"sourceBucket": "foo",
+			"destinationBucket": "arn:aws:s3:::inventory",
+			"fileFormat": "CSV",
+			"fileSchema": "Bucket, Key, Size, LastModifiedDate, ETag, IsLatest, IsDeleteMarker",
+			"files": [{"key": "data/1.csv.gz"}, {"key": "data/2.csv.gz"}, {"key": "data/3.csv.gz"}]
+		}`),
+	}
+	for key, rows := range map[string]string{
+		"data/1.csv.gz": `"foo","other/a","1","2018-01-03T04:00:00.000Z","aaa","true","false"
+"foo","stream/a%20b","1","2018-01-03T04:00:00.000Z","aaa","true","false"
+"foo","stream/c","3","2018-01-03T04:00:00.000Z","ccc","true","false"
+`,
+		"data/2.csv.gz": `"foo","stream/b","2","2018-01-03T04:00:00.000Z","bbb","true","false"
+"foo","stream/b","2","2018-01-03T04:00:00.000Z","","false","true"
+"foo","stream/d","4","2018-01-03T04:00:00.000Z","ddd","true","false"
+`,
+		"data/3.csv.gz": "",
+		// a file that is not sorted by key
+		"unsorted.csv.gz": `"foo","stream/b","2","2018-01-03T04:00:00.000Z","bbb","true","false"
+"foo","stream/a","1","2018-01-03T04:00:00.000Z","aaa","true","false"
+`,
+	} {
+		gz := &bytes.Buffer{}
+		w := gzip.NewWriter(gz)
+		w.Write([]byte(rows))
+		w.Close()
+		files[key] = gz.Bytes()
+	}
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+			return &s3.GetObjectOutput{
+				Body: ioutil.NopCloser(bytes.NewReader(files[*in.Key])),
+			}
+		}, nil)
+
+	// create archive that reads the inventory
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.Inventory = "s3://inventory/manifest.json"
+	config.Prefix = "stream/"
+	config.StopAt = "stream/d"
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// invoke scan
+	pending := make(chan *s3.Object, 4)
+	archive.scan(pending)
+	objects := []*s3.Object{}
+	for o := range pending {
+		objects = append(objects, o)
+	}
+	assert.Len(t, objects, 3)
+	keys := []string{}
+	for _, o := range objects {
+		keys = append(keys, *o.Key)
+	}
+	assert.Equal(t, []string{"stream/a b", "stream/b", "stream/c"}, keys)
+	assert.Equal(t, `"bbb"`, *objects[1].ETag)
+	assert.Equal(t, int64(2), *objects[1].Size)
+	assert.Equal(t, time.Date(2018, 1, 3, 4, 0, 0, 0, time.UTC), *objects[1].LastModified)
+
+	// an unsorted file fails the scan rather than replaying out of order
+	files["manifest.json"] = []byte(`{
+		"sourceBucket": "foo",
+		"fileFormat": "CSV",
+		"fileSchema": "Bucket, Key, Size, LastModifiedDate, ETag, IsLatest, IsDeleteMarker",
+		"files": [{"key": "unsorted.csv.gz"}]
+	}`)
+	err = archive.scanInventory(make(chan *s3.Object, 4))
+	assert.EqualError(t, err, "inventory file is not sorted by key: unsorted.csv.gz")
+}
+
+func TestScanInventoryParquet(t *testing.T) {
+	// create an inventory whose parquet data file, written by parquet-go, has
+	// optional, dictionary encoded and snappy compressed columns split across
+	// row groups
+	data, err := ioutil.ReadFile("testdata/inventory.parquet")
+	assert.Nil(t, err)
+	files := map[string][]byte{
+		"manifest.json": []byte(`{
+			"sourceBucket": "foo",
+			"destinationBucket": "arn:aws:s3:::inventory",
+			"fileFormat": "Parquet",
+			"fileSchema": "message s3.inventory { optional binary bucket (UTF8); optional binary key (UTF8); }",
+			"files": [{"key": "data/1.parquet"}]
+		}`),
+		"data/1.parquet": data,
+	}
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+			return &s3.GetObjectOutput{
+				Body: ioutil.NopCloser(bytes.NewReader(files[*in.Key])),
+			}
+		}, nil)
+
+	// create archive that reads the inventory
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.Inventory = "s3://inventory/manifest.json"
+	config.Prefix = "stream/"
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// invoke scan, expecting the latest versions of the bucket's objects
+	// under the prefix
+	pending := make(chan *s3.Object, 4)
+	archive.scan(pending)
+	objects := []*s3.Object{}
+	for o := range pending {
+		objects = append(objects, o)
+	}
+	modified := aws.Time(time.Date(2018, 1, 3, 4, 0, 0, 0, time.UTC))
+	assert.Equal(t, []*s3.Object{
+		{ETag: aws.String(`"aaa"`), Key: aws.String("stream/a b"), LastModified: modified, Size: aws.Int64(1), StorageClass: aws.String("STANDARD")},
+		{ETag: aws.String(`"bbb"`), Key: aws.String("stream/b"), LastModified: modified, Size: aws.Int64(2), StorageClass: aws.String("GLACIER")},
+		{Key: aws.String("stream/e"), StorageClass: aws.String("STANDARD")},
+	}, objects)
+}
+
+func TestScanInventoryORC(t *testing.T) {
+	// create an inventory whose zlib compressed orc data file has optional,
+	// dictionary encoded and version 1 and 2 run length encoded columns in
+	// two stripes
+	data, err := ioutil.ReadFile("testdata/inventory.orc")
+	assert.Nil(t, err)
+	files := map[string][]byte{
+		"manifest.json": []byte(`{
+			"sourceBucket": "foo",
+			"destinationBucket": "arn:aws:s3:::inventory",
+			"fileFormat": "ORC",
+			"fileSchema": "struct<bucket:string,key:string,version_id:string,is_latest:boolean,is_delete_marker:boolean,size:bigint,last_modified_date:timestamp,e_tag:string,storage_class:string>",
+			"files": [{"key": "data/1.orc"}]
+		}`),
+		"data/1.orc": data,
+	}
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+			return &s3.GetObjectOutput{
+				Body: ioutil.NopCloser(bytes.NewReader(files[*in.Key])),
+			}
+		}, nil)
+
+	// create archive that reads the inventory
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.Inventory = "s3://inventory/manifest.json"
+	config.Prefix = "stream/"
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// invoke scan, expecting the latest versions of the bucket's objects
+	// under the prefix
+	pending := make(chan *s3.Object, 4)
+	archive.scan(pending)
+	objects := []*s3.Object{}
+	for o := range pending {
+		objects = append(objects, o)
+	}
+	modified := time.Date(2018, 1, 3, 4, 0, 0, 0, time.UTC)
+	assert.Equal(t, []*s3.Object{
+		{ETag: aws.String(`"aaa"`), Key: aws.String("stream/a b"), LastModified: aws.Time(modified), Size: aws.Int64(1), StorageClass: aws.String("STANDARD")},
+		{ETag: aws.String(`"bbb"`), Key: aws.String("stream/b"), LastModified: aws.Time(modified), Size: aws.Int64(2), StorageClass: aws.String("GLACIER")},
+		{ETag: aws.String(`"ddd"`), Key: aws.String("stream/d"), LastModified: aws.Time(modified.Add(500 * time.Millisecond)), Size: aws.Int64(4), StorageClass: aws.String("STANDARD")},
+		{Key: aws.String("stream/e"), StorageClass: aws.String("STANDARD")},
+	}, objects)
+
+	// a truncated file fails the scan
+	files["data/1.orc"] = data[:len(data)/2]
+	err = archive.scanInventory(make(chan *s3.Object, 4))
+	assert.EqualError(t, err, "not an orc file")
+}
+
+func TestScanInventoryUnsupported(t *testing.T) {
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(&s3.GetObjectOutput{
+			Body: ioutil.NopCloser(strings.NewReader(`{"sourceBucket":"foo","fileFormat":"Avro","files":[]}`)),
+		}, nil)
+	archive := &Archive{
+		bucket:          aws.String("foo"),
+		client:          client,
+		inventoryBucket: aws.String("inventory"),
+		inventoryKey:    aws.String("manifest.json"),
+		log:             logrus.WithField("test", true),
+	}
+	err := archive.scanInventory(make(chan *s3.Object))
+	assert.EqualError(t, err, "unsupported inventory format: Avro")
+	client.AssertNumberOfCalls(t, "GetObject", 1)
+}
+
+func TestScanKeys(t *testing.T) {
+	// the keys of a two bucket file are split between their sources
+	file := "foo,b\nbar,a\nfoo,\"a,1\"\n\nfoo,c\nbar,d\nfoo,b\n"
+	keys, skipped, err := ReadKeys(strings.NewReader(file), "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "a,1", "c", "b"}, keys)
+	assert.Equal(t, 2, skipped)
+	barKeys, skipped, err := ReadKeys(strings.NewReader(file), "bar")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "d"}, barKeys)
+	assert.Equal(t, 4, skipped)
+
+	// create mock s3 client that describes each key
+	client := &mock.S3API{}
+	client.On("HeadObject", mocks.AnythingOfType("*s3.HeadObjectInput")).
+		Return(func(in *s3.HeadObjectInput) *s3.HeadObjectOutput {
+			return &s3.HeadObjectOutput{
+				ContentLength: aws.Int64(int64(len(*in.Key))),
+				ETag:          aws.String(`"` + *in.Key + `"`),
+			}
+		}, nil)
+
+	// create archive that replays the keys after a start key
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.Keys = keys
+	config.StartAfter = "a,1"
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// invoke scan, expecting sorted and deduplicated keys
+	pending := make(chan *s3.Object, 4)
+	archive.scan(pending)
+	objects := []*s3.Object{}
+	for o := range pending {
+		objects = append(objects, o)
+	}
+	assert.Len(t, objects, 2)
+	assert.Equal(t, "b", *objects[0].Key)
+	assert.Equal(t, `"b"`, *objects[0].ETag)
+	assert.Equal(t, "c", *objects[1].Key)
+	client.AssertNumberOfCalls(t, "HeadObject", 2)
+}
+
+func TestBudget(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	budget := NewBudget(100, log)
+	a, b := &Archive{}, &Archive{}
+
+	// objects larger than the budget are capped, and a second archive may
+	// always hold a single object
+	assert.Equal(t, int64(100), budget.acquire(a, "a1", 150))
+	assert.Equal(t, int64(60), budget.acquire(b, "b1", 60))
+	assert.Equal(t, int64(160), budget.Used())
+
+	// further downloads block until enough bytes are released
+	acquired := make(chan int64)
+	go func() {
+		acquired <- budget.acquire(a, "a2", 40)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to block")
+	case <-time.After(time.Millisecond * 10):
+	}
+	budget.release(a, 100)
+	assert.Equal(t, int64(40), <-acquired)
+	assert.Equal(t, int64(100), budget.Used())
+
+	// blocked downloads log the in-flight bytes at info level
+	entries := hook.AllEntries()
+	assert.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.Equal(t, logrus.InfoLevel, e.Level)
+	}
+	assert.Equal(t, int64(160), entries[0].Data["inflight"])
+	assert.Equal(t, int64(60), entries[1].Data["inflight"])
+}
+
+func TestScanVersions(t *testing.T) {
+	asOf := time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC)
+	before, after := asOf.Add(-time.Hour), asOf.Add(time.Hour)
+	v := func(key, id string, modified time.Time) *s3.ObjectVersion {
+		return &s3.ObjectVersion{Key: aws.String(key), VersionId: aws.String(id), LastModified: aws.Time(modified)}
+	}
+	pages := []*s3.ListObjectVersionsOutput{
+		{
+			Versions: []*s3.ObjectVersion{
+				// rewritten after the point in time
+				v("a", "a3", after),
+				v("a", "a2", before),
+				v("a", "a1", before.Add(-time.Hour)),
+				// deleted before the point in time
+				v("b", "b1", before.Add(-time.Hour)),
+				// created after the point in time
+				v("c", "c1", after),
+				// versions of d span pages
+				v("d", "d2", after),
+			},
+			DeleteMarkers: []*s3.DeleteMarkerEntry{
+				{Key: aws.String("b"), VersionId: aws.String("b2"), LastModified: aws.Time(before)},
+			},
+		},
+		{
+			Versions: []*s3.ObjectVersion{
+				v("d", "d1", before),
+			},
+		},
+	}
+	client := &mock.S3API{}
+	client.On("ListObjectVersionsPages", mocks.AnythingOfType("*s3.ListObjectVersionsInput"), mocks.AnythingOfType("func(*s3.ListObjectVersionsOutput, bool) bool")).
+		Run(func(args mocks.Arguments) {
+			cb := args.Get(1).(func(*s3.ListObjectVersionsOutput, bool) bool)
+			for i, page := range pages {
+				if !cb(page, i < len(pages)-1) {
+					return
+				}
+			}
+		}).
+		Return(nil)
+
+	// create archive for the point in time
+	config := NewArchiveConfig()
+	config.AsOf = asOf
+	config.Bucket = "foo"
+	config.Client = client
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// invoke scan, expecting the current version of each existing key
+	pending := make(chan *s3.Object, 4)
+	archive.scan(pending)
+	versions := []string{}
+	for o := range pending {
+		versions = append(versions, *o.Key+"@"+*archive.version(o))
+	}
+	assert.Equal(t, []string{"a@a2", "d@d1"}, versions)
+}
+
+func TestRestore(t *testing.T) {
+	listing := &s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("a"), StorageClass: aws.String("STANDARD")},
+			{Key: aws.String("b"), StorageClass: aws.String("DEEP_ARCHIVE")},
+		},
+	}
+	for _, mode := range []string{RestoreOnly, RestoreWait} {
+		// create mock s3 client whose restore completes on the second check
+		client := &mock.S3API{}
+		client.On("ListObjectsV2Pages", mocks.AnythingOfType("*s3.ListObjectsV2Input"), mocks.AnythingOfType("func(*s3.ListObjectsV2Output, bool) bool")).
+			Run(func(args mocks.Arguments) {
+				cb := args.Get(1).(func(*s3.ListObjectsV2Output, bool) bool)
+				cb(listing, false)
+			}).
+			Return(nil)
+		client.On("RestoreObject", mocks.MatchedBy(func(in *s3.RestoreObjectInput) bool {
+			return *in.Key == "b" && *in.RestoreRequest.GlacierJobParameters.Tier == s3.TierBulk
+		})).Return(&s3.RestoreObjectOutput{}, nil).Once()
+		client.On("HeadObject", mocks.AnythingOfType("*s3.HeadObjectInput")).
+			Return(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="true"`)}, nil).Once()
+		client.On("HeadObject", mocks.AnythingOfType("*s3.HeadObjectInput")).
+			Return(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)}, nil).Once()
+		client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+			Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+				return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("{}"))}
+			}, nil)
+
+		config := NewArchiveConfig()
+		config.Bucket = "foo"
+		config.Client = client
+		config.Concurrency = 1
+		config.Restore = mode
+		config.RestoreInterval = time.Millisecond
+		config.RestoreTier = s3.TierBulk
+		archive, err := NewArchive(config)
+		assert.Nil(t, err)
+
+		// restored objects are replayed in order, unless only restoring
+		keys := []string{}
+		for o := range archive.Scan() {
+			keys = append(keys, *o.Object.Key)
+			o.Body.Close()
+		}
+		if mode == RestoreOnly {
+			assert.Empty(t, keys)
+			client.AssertNotCalled(t, "HeadObject", mocks.Anything)
+		} else {
+			assert.Equal(t, []string{"a", "b"}, keys)
+			client.AssertNumberOfCalls(t, "HeadObject", 2)
+		}
+		client.AssertNumberOfCalls(t, "RestoreObject", 1)
+	}
+}
+
+func TestRestoreFailed(t *testing.T) {
+	listing := &s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("a"), StorageClass: aws.String("GLACIER")},
+			{Key: aws.String("b"), StorageClass: aws.String("GLACIER")},
+		},
+	}
+	// create mock s3 client that cannot restore a and never completes b
+	client := &mock.S3API{}
+	client.On("ListObjectsV2Pages", mocks.AnythingOfType("*s3.ListObjectsV2Input"), mocks.AnythingOfType("func(*s3.ListObjectsV2Output, bool) bool")).
+		Run(func(args mocks.Arguments) {
+			cb := args.Get(1).(func(*s3.ListObjectsV2Output, bool) bool)
+			cb(listing, false)
+		}).
+		Return(nil)
+	client.On("RestoreObject", mocks.MatchedBy(func(in *s3.RestoreObjectInput) bool {
+		return *in.Key == "a"
+	})).Return(nil, errors.New("access denied"))
+	client.On("RestoreObject", mocks.MatchedBy(func(in *s3.RestoreObjectInput) bool {
+		return *in.Key == "b"
+	})).Return(&s3.RestoreObjectOutput{}, nil)
+	client.On("HeadObject", mocks.AnythingOfType("*s3.HeadObjectInput")).
+		Return(&s3.HeadObjectOutput{Restore: aws.String(`ongoing-request="true"`)}, nil)
+
+	// create archive that reports failed objects
+	dir, err := ioutil.TempDir("", "report")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	reportConfig := NewReportConfig()
+	reportConfig.File = filepath.Join(dir, "failed.csv")
+	report, err := NewReport(reportConfig)
+	assert.Nil(t, err)
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.Concurrency = 1
+	config.Reporter = report
+	config.Restore = RestoreWait
+	config.RestoreInterval = time.Millisecond
+	config.RestoreMaxWait = 10 * time.Millisecond
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// neither object is replayed, and both are reported
+	for o := range archive.Scan() {
+		t.Errorf("unexpected object %s", *o.Object.Key)
+		o.Body.Close()
+	}
+	client.AssertNotCalled(t, "GetObject", mocks.Anything)
+	assert.Nil(t, report.Close())
+	data, err := ioutil.ReadFile(reportConfig.File)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "foo,a,error initiating restore: access denied")
+	assert.Contains(t, string(data), "foo,b,"+errRestoreTimeout.Error())
+}
+
+func TestBucketAccess(t *testing.T) {
+	key := strings.Repeat("k", 32)
+
+	// create mock s3 client that captures object requests
+	client := &mock.S3API{}
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(&s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("data"))}, nil)
+	client.On("HeadObject", mocks.AnythingOfType("*s3.HeadObjectInput")).
+		Return(&s3.HeadObjectOutput{}, nil)
+
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = client
+	config.RequestPayer = true
+	config.SSECustomerKey = "short"
+	_, err := NewArchive(config)
+	assert.EqualError(t, err, "sse customer key must be 32 bytes")
+	config.ExpectedBucketOwner = "123456789012"
+	config.SSECustomerKey = key
+	_, err = NewArchive(config)
+	assert.EqualError(t, err, "expected bucket owner requires an s3 client")
+	config.ExpectedBucketOwner = ""
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// open and describe an object, expecting requester pays and sse-c
+	// parameters
+	body, _, err := archive.open(&s3.Object{Key: aws.String("a")})
+	assert.Nil(t, err)
+	body.Close()
+	get := client.Calls[0].Arguments.Get(0).(*s3.GetObjectInput)
+	assert.Equal(t, s3.RequestPayerRequester, aws.StringValue(get.RequestPayer))
+	assert.Equal(t, s3.ServerSideEncryptionAes256, aws.StringValue(get.SSECustomerAlgorithm))
+	assert.Equal(t, key, aws.StringValue(get.SSECustomerKey))
+	_, err = archive.headObject(aws.String("a"), nil)
+	assert.Nil(t, err)
+	head := client.Calls[1].Arguments.Get(0).(*s3.HeadObjectInput)
+	assert.Equal(t, s3.RequestPayerRequester, aws.StringValue(head.RequestPayer))
+	assert.Equal(t, key, aws.StringValue(head.SSECustomerKey))
+
+	// expect the bucket owner header on requests for the archive bucket only
+	headers := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers[r.URL.Path] = r.Header.Get("X-Amz-Expected-Bucket-Owner")
+		w.Write([]byte(`<ListBucketResult></ListBucketResult>`))
+	}))
+	defer server.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	s3Client := s3.New(sess)
+	config = NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = s3Client
+	config.ExpectedBucketOwner = "123456789012"
+	_, err = NewArchive(config)
+	assert.Nil(t, err)
+	for _, bucket := range []string{"foo", "bar"} {
+		_, err = s3Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, map[string]string{"/foo": "123456789012", "/bar": ""}, headers)
+}
+
+func TestScanOrdered(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	contents := []*s3.Object{}
+	for _, key := range keys {
+		contents = append(contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(10)})
+	}
+
+	// create mock s3 client whose earlier objects take longer to download,
+	// and which fails to download one object
+	client := &mock.S3API{}
+	client.On("ListObjectsV2Pages", mocks.AnythingOfType("*s3.ListObjectsV2Input"), mocks.AnythingOfType("func(*s3.ListObjectsV2Output, bool) bool")).
+		Run(func(args mocks.Arguments) {
+			cb := args.Get(1).(func(*s3.ListObjectsV2Output, bool) bool)
+			cb(&s3.ListObjectsV2Output{Contents: contents}, false)
+		}).
+		Return(nil)
+	client.On("GetObject", mocks.AnythingOfType("*s3.GetObjectInput")).
+		Return(func(in *s3.GetObjectInput) *s3.GetObjectOutput {
+			time.Sleep(time.Duration('g'-(*in.Key)[0]) * 5 * time.Millisecond)
+			return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(*in.Key))}
+		}, func(in *s3.GetObjectInput) error {
+			if *in.Key == "c" {
+				return errors.New("unexpected")
+			}
+			return nil
+		})
+
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Budget = NewBudget(30, logrus.WithField("test", true))
+	config.Client = client
+	config.Concurrency = 4
+	config.MaxAttempts = 1
+	config.Ordered = true
+	archive, err := NewArchive(config)
+	assert.Nil(t, err)
+
+	// expect objects in key order despite later objects completing first
+	emitted := []string{}
+	for o := range archive.Scan() {
+		emitted = append(emitted, *o.Object.Key)
+		o.Body.Close()
+	}
+	assert.Equal(t, []string{"a", "b", "d", "e", "f"}, emitted)
+	assert.Equal(t, int64(0), config.Budget.Used())
+}
+
+func TestSample(t *testing.T) {
+	keys := []string{}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("%04d", i))
+	}
+	scan := func(every int, percent float64) []string {
+		config := NewArchiveConfig()
+		config.Bucket = "foo"
+		config.Client = listClient(append([]string{}, keys...))
+		config.SampleEvery = every
+		config.SamplePercent = percent
+		archive, err := NewArchive(config)
+		assert.Nil(t, err)
+		pending := make(chan *s3.Object, len(keys))
+		archive.scan(pending)
+		queued := []string{}
+		for o := range pending {
+			queued = append(queued, *o.Key)
+		}
+		return queued
+	}
+
+	// keep every Nth object starting with the first
+	sampled := scan(100, 0)
+	assert.Len(t, sampled, 10)
+	assert.Equal(t, "0000", sampled[0])
+	assert.Equal(t, "0100", sampled[1])
+
+	// keep a random percentage of objects
+	sampled = scan(0, 25)
+	assert.InDelta(t, 250, len(sampled), 100)
+	assert.Len(t, scan(0, 100), 1000)
+	assert.Len(t, scan(2, 0), 500)
+
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = &mock.S3API{}
+	config.SamplePercent = 101
+	_, err := NewArchive(config)
+	assert.NotNil(t, err)
+}
+
+func TestScanStopAtModes(t *testing.T) {
+	keys := []string{"a/1", "b/1", "b/2", "b/3", "c/1"}
+	scan := func(prefix, startAfter, stopAt, mode string) ([]string, []string) {
+		log, hook := test.NewNullLogger()
+		config := NewArchiveConfig()
+		config.Bucket = "foo"
+		config.Client = listClient(append([]string{}, keys...))
+		config.Log = log
+		config.Prefix = prefix
+		config.StartAfter = startAfter
+		config.StopAt = stopAt
+		config.StopAtMode = mode
+		archive, err := NewArchive(config)
+		assert.Nil(t, err)
+		pending := make(chan *s3.Object, len(keys))
+		archive.scan(pending)
+		queued := []string{}
+		for o := range pending {
+			queued = append(queued, *o.Key)
+		}
+		warnings := []string{}
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel {
+				warnings = append(warnings, e.Message)
+			}
+		}
+		return queued, warnings
+	}
+
+	testcases := []struct {
+		prefix, startAfter, stopAt, mode string
+		expected                         []string
+		warned                           bool
+	}{
+		{"", "", "b/2", "", []string{"a/1", "b/1"}, false},
+		{"", "", "b/2", replay.StopInclusive, []string{"a/1", "b/1", "b/2"}, false},
+		// a bound that does not exist still stops the scan
+		{"", "", "b/25", replay.StopExclusive, []string{"a/1", "b/1", "b/2"}, false},
+		{"", "", "b/", replay.StopPrefix, []string{"a/1", "b/1", "b/2", "b/3"}, false},
+		{"", "", "b", replay.StopExclusive, []string{"a/1"}, false},
+		// bounds that cannot match anything under the prefix
+		{"b/", "", "a/1", replay.StopInclusive, []string{}, true},
+		{"", "b/1", "b/1", replay.StopExclusive, []string{}, true},
+		{"b/", "", "c", replay.StopExclusive, []string{"b/1", "b/2", "b/3"}, true},
+	}
+	for _, tc := range testcases {
+		queued, warnings := scan(tc.prefix, tc.startAfter, tc.stopAt, tc.mode)
+		assert.Equal(t, tc.expected, queued, tc.stopAt)
+		assert.Equal(t, tc.warned, len(warnings) > 0, tc.stopAt)
+	}
+
+	config := NewArchiveConfig()
+	config.Bucket = "foo"
+	config.Client = &mock.S3API{}
+	config.StopAtMode = "before"
+	_, err := NewArchive(config)
+	assert.EqualError(t, err, "invalid stop at mode: before")
 }
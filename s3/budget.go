@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Budget limits the number of bytes of archive objects that have been opened
+// for download but not yet consumed by the parser, and may be shared by
+// multiple archives. Each archive may always hold a single object regardless
+// of the budget, so that interleaving sources cannot starve one another.
+//
+// Objects are charged their stored size, which is their compressed size when
+// they are compressed, as their decompressed size is not known until they are
+// read. Objects are decompressed as they are streamed to the parser rather
+// than held in memory, so the budget bounds the downloaded bytes buffered
+// ahead of the parser rather than their decompressed size.
+type Budget struct {
+	// A condition used to wake blocked downloads as bytes are released
+	cond *sync.Cond
+	// The number of objects held by each archive
+	held map[*Archive]int
+	// The maximum number of in-flight bytes
+	limit int64
+	// A logger instance
+	log logrus.FieldLogger
+	// The current number of in-flight bytes
+	used int64
+}
+
+// NewBudget returns a new in-flight byte budget
+func NewBudget(limit int64, log logrus.FieldLogger) *Budget {
+	return &Budget{
+		cond:  sync.NewCond(&sync.Mutex{}),
+		held:  make(map[*Archive]int),
+		limit: limit,
+		log:   log,
+	}
+}
+
+// acquire blocks until n bytes are available to an archive, returning the
+// number of bytes acquired, which is capped at the limit
+func (b *Budget) acquire(a *Archive, key string, n int64) int64 {
+	if n > b.limit {
+		n = b.limit
+	}
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	if b.held[a] > 0 && b.used+n > b.limit {
+		b.log.WithFields(logrus.Fields{
+			"inflight": b.used,
+			"key":      key,
+			"limit":    b.limit,
+			"size":     n,
+		}).Infoln("waiting for in-flight bytes to be released")
+		start := time.Now()
+		for b.held[a] > 0 && b.used+n > b.limit {
+			b.cond.Wait()
+		}
+		b.log.WithFields(logrus.Fields{
+			"inflight": b.used,
+			"key":      key,
+			"limit":    b.limit,
+			"wait":     time.Since(start),
+		}).Infoln("in-flight bytes released")
+	}
+	b.held[a]++
+	b.used += n
+	return n
+}
+
+// release returns an archive's n bytes to the budget
+func (b *Budget) release(a *Archive, n int64) {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	b.held[a]--
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// Used returns the current number of in-flight bytes
+func (b *Budget) Used() int64 {
+	b.cond.L.Lock()
+	defer b.cond.L.Unlock()
+	return b.used
+}
+
+// budgetCloser releases an object's bytes back to the budget when its stream
+// is closed
+type budgetCloser struct {
+	archive *Archive
+	budget  *Budget
+	n       int64
+	once    *sync.Once
+}
+
+// Close releases the object's bytes, at most once
+func (c *budgetCloser) Close() error {
+	c.once.Do(func() {
+		c.budget.release(c.archive, c.n)
+	})
+	return nil
+}
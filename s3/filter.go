@@ -0,0 +1,145 @@
+package s3
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// filter describes the rules a listed object must satisfy to be queued
+type filter struct {
+	// patterns of which a key must match at least one, if any are defined
+	include []*regexp.Regexp
+	// patterns of which a key must match none
+	exclude []*regexp.Regexp
+	// optional inclusive object size bounds
+	minSize int64
+	maxSize int64
+	// optional object last modified bounds, inclusive of after and
+	// exclusive of before
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+}
+
+// newFilter compiles the filter rules defined in an archive configuration
+func newFilter(c *ArchiveConfig) (*filter, error) {
+	f := &filter{
+		maxSize:        c.MaxSize,
+		minSize:        c.MinSize,
+		modifiedAfter:  c.ModifiedAfter,
+		modifiedBefore: c.ModifiedBefore,
+	}
+	var err error
+	if f.include, err = compile(c.Include, c.IncludeGlob); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compile(c.Exclude, c.ExcludeGlob); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// match determines whether an object satisfies all filter rules
+func (f *filter) match(o *s3.Object) bool {
+	key := aws.StringValue(o.Key)
+	if len(f.include) > 0 && !matchAny(f.include, key) {
+		return false
+	}
+	if matchAny(f.exclude, key) {
+		return false
+	}
+	size := aws.Int64Value(o.Size)
+	if f.minSize > 0 && size < f.minSize {
+		return false
+	}
+	if f.maxSize > 0 && size > f.maxSize {
+		return false
+	}
+	modified := aws.TimeValue(o.LastModified)
+	if !f.modifiedAfter.IsZero() && modified.Before(f.modifiedAfter) {
+		return false
+	}
+	if !f.modifiedBefore.IsZero() && !modified.Before(f.modifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// matchAny returns true if any of the patterns match the key
+func matchAny(patterns []*regexp.Regexp, key string) bool {
+	for _, p := range patterns {
+		if p.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// compile compiles a set of regular expressions and glob patterns
+func compile(expressions, globs []string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, e := range expressions {
+		p, err := regexp.Compile(e)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	for _, g := range globs {
+		p, err := Glob(g)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// Glob compiles a glob pattern that must match an entire key into a regular
+// expression, where * matches any sequence of characters other than /, **
+// matches any sequence of characters, **/ matches zero or more path segments,
+// ? matches a single character other than /, and [...] matches a character
+// class
+func Glob(pattern string) (*regexp.Regexp, error) {
+	expr := &bytes.Buffer{}
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+2 < len(pattern) && pattern[i+1] == '*' && pattern[i+2] == '/' {
+				expr.WriteString("(?:.*/)?")
+				i += 2
+			} else if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := i + 1
+			for end < len(pattern) && pattern[end] != ']' {
+				end++
+			}
+			if end == len(pattern) {
+				expr.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = end
+				continue
+			}
+			class := pattern[i+1 : end]
+			if len(class) > 0 && class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i = end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
@@ -0,0 +1,526 @@
+package s3
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"s3-kinesis-replay/decompress"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// supported s3 inventory data file formats
+const (
+	InventoryCSV     = "CSV"
+	InventoryORC     = "ORC"
+	InventoryParquet = "Parquet"
+)
+
+// inventoryRows is the number of rows read from each column of an orc or
+// parquet inventory file at once
+const inventoryRows = 10000
+
+// inventoryColumnNames are the relevant columns of orc and parquet inventory
+// files
+var inventoryColumnNames = []string{"bucket", "key", "size", "last_modified_date", "e_tag", "storage_class", "is_latest", "is_delete_marker"}
+
+// manifest describes an s3 inventory manifest.json file
+type manifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// inventoryReader reads the relevant objects of an inventory data file in
+// file order, returning io.EOF after the last object
+type inventoryReader interface {
+	next() (*s3.Object, error)
+	Close() error
+}
+
+// inventoryFile is an open inventory data file and its next object
+type inventoryFile struct {
+	inventoryReader
+	key    string
+	object *s3.Object
+}
+
+// inventoryFiles orders open inventory data files by the key of their next
+// object, implementing heap.Interface
+type inventoryFiles []*inventoryFile
+
+func (f inventoryFiles) Len() int           { return len(f) }
+func (f inventoryFiles) Less(i, j int) bool { return *f[i].object.Key < *f[j].object.Key }
+func (f inventoryFiles) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func (f *inventoryFiles) Push(x interface{}) {
+	*f = append(*f, x.(*inventoryFile))
+}
+
+func (f *inventoryFiles) Pop() interface{} {
+	old := *f
+	file := old[len(old)-1]
+	*f = old[:len(old)-1]
+	return file
+}
+
+// csvInventory reads the rows of a csv inventory file
+type csvInventory struct {
+	bucket  string
+	closers []io.Closer
+	columns map[string]int
+	r       *csv.Reader
+}
+
+// inventoryColumns reads the rows of a columnar inventory file in batches
+type inventoryColumns interface {
+	// read returns the values of the named columns for the next batch of
+	// rows, returning io.EOF after the last batch. Nulls and absent columns
+	// are read as nil, strings as string, integers as int64, booleans as bool
+	// and timestamps as time.Time values.
+	read(names []string) ([][]interface{}, error)
+	Close() error
+}
+
+// columnarInventory reads the objects of an orc or parquet inventory file
+type columnarInventory struct {
+	inventoryColumns
+	bucket  string
+	objects []*s3.Object
+}
+
+// parquetInventory reads the columns of a parquet inventory file
+type parquetInventory struct {
+	reader *reader.ParquetReader
+	rows   int64
+	tmp    *os.File
+}
+
+// parquetSource is a parquet-go source reading a local file, opening a new
+// handle for each column read
+type parquetSource struct {
+	*os.File
+}
+
+// ParseInventory parses an s3 inventory manifest location of the form
+// s3://<bucket>/<key>, returning its bucket and key
+func ParseInventory(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || u.Host == "" || key == "" {
+		return "", "", errors.New("inventory must be an s3://<bucket>/<key> uri: " + uri)
+	}
+	return u.Host, key, nil
+}
+
+// scanInventory reads the archive's objects from an s3 inventory instead of
+// listing the bucket, queueing those within the configured prefixes in key
+// order
+func (a *Archive) scanInventory(pending chan *s3.Object) error {
+	m, err := a.manifest()
+	if err != nil {
+		return err
+	}
+	if m.SourceBucket != "" && m.SourceBucket != *a.bucket {
+		return fmt.Errorf("inventory is for bucket %s, not %s", m.SourceBucket, *a.bucket)
+	}
+	// files are stored in the destination bucket, if it differs from the
+	// bucket containing the manifest
+	bucket := a.inventoryBucket
+	if m.DestinationBucket != "" {
+		bucket = aws.String(m.DestinationBucket[strings.LastIndex(m.DestinationBucket, ":")+1:])
+	}
+	// merge the data files, each of which is sorted by key, holding only the
+	// next object of each file rather than the whole inventory
+	files := &inventoryFiles{}
+	defer func() {
+		for _, f := range *files {
+			f.Close()
+		}
+	}()
+	push := func(f *inventoryFile) error {
+		o, err := f.next()
+		if err == io.EOF {
+			return f.Close()
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		f.object = o
+		heap.Push(files, f)
+		return nil
+	}
+	for _, f := range m.Files {
+		a.log.WithField("key", f.Key).Debugln("reading inventory file")
+		file := &inventoryFile{key: f.Key}
+		switch m.FileFormat {
+		case InventoryCSV:
+			file.inventoryReader, err = a.openInventoryCSV(bucket, f.Key, m.FileSchema)
+		case InventoryORC:
+			file.inventoryReader, err = a.openInventoryORC(bucket, f.Key)
+		case InventoryParquet:
+			file.inventoryReader, err = a.openInventoryParquet(bucket, f.Key)
+		}
+		if err == nil {
+			err = push(file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	objects := 0
+	last := ""
+	for files.Len() > 0 {
+		f := heap.Pop(files).(*inventoryFile)
+		o := f.object
+		if *o.Key < last {
+			f.Close()
+			return errors.New("inventory file is not sorted by key: " + f.key)
+		}
+		last = *o.Key
+		if err := push(f); err != nil {
+			return err
+		}
+		if !a.listed(*o.Key) {
+			continue
+		}
+		objects++
+		if !a.queue(o, nil, pending) {
+			break
+		}
+	}
+	a.log.WithField("objects", objects).Infoln("inventory read")
+	return nil
+}
+
+// listed determines whether a key would have been returned when listing the
+// configured prefixes after the start key
+func (a *Archive) listed(key string) bool {
+	if a.startAfter != nil && key <= *a.startAfter {
+		return false
+	}
+	if len(a.prefixes) == 0 {
+		return strings.HasPrefix(key, aws.StringValue(a.prefix))
+	}
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(key, *prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifest downloads and decodes the inventory manifest, rejecting
+// inventories whose data file format cannot be read
+func (a *Archive) manifest() (*manifest, error) {
+	output, err := a.client.GetObject(&s3.GetObjectInput{
+		Bucket: a.inventoryBucket,
+		Key:    a.inventoryKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	m := &manifest{}
+	if err := json.NewDecoder(output.Body).Decode(m); err != nil {
+		return nil, err
+	}
+	switch m.FileFormat {
+	case InventoryCSV, InventoryORC, InventoryParquet:
+	default:
+		return nil, errors.New("unsupported inventory format: " + m.FileFormat)
+	}
+	return m, nil
+}
+
+// openInventoryCSV opens a gzip compressed csv inventory file, whose columns
+// are described by the manifest file schema
+func (a *Archive) openInventoryCSV(bucket *string, key, schema string) (*csvInventory, error) {
+	columns := map[string]int{}
+	for i, name := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["Key"]; !ok {
+		return nil, errors.New("inventory schema has no Key column: " + schema)
+	}
+	output, err := a.client.GetObject(&s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := decompress.NewReader(decompress.Gzip, output.Body)
+	if err != nil {
+		output.Body.Close()
+		return nil, err
+	}
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	return &csvInventory{
+		bucket:  *a.bucket,
+		closers: []io.Closer{body, output.Body},
+		columns: columns,
+		r:       r,
+	}, nil
+}
+
+// next returns the object of the file's next relevant row
+func (c *csvInventory) next() (*s3.Object, error) {
+	for {
+		row, err := c.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := c.columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		if field("IsDeleteMarker") == "true" || field("IsLatest") == "false" {
+			continue
+		}
+		if b := field("Bucket"); b != "" && b != c.bucket {
+			continue
+		}
+		k, err := url.QueryUnescape(field("Key"))
+		if err != nil {
+			return nil, err
+		}
+		o := &s3.Object{Key: aws.String(k)}
+		if size, err := strconv.ParseInt(field("Size"), 10, 64); err == nil {
+			o.Size = aws.Int64(size)
+		}
+		if modified, err := time.Parse(time.RFC3339, field("LastModifiedDate")); err == nil {
+			o.LastModified = aws.Time(modified)
+		}
+		if etag := field("ETag"); etag != "" {
+			o.ETag = aws.String(strconv.Quote(etag))
+		}
+		if class := field("StorageClass"); class != "" {
+			o.StorageClass = aws.String(class)
+		}
+		return o, nil
+	}
+}
+
+// Close closes the file's stream
+func (c *csvInventory) Close() error {
+	var err error
+	for _, closer := range c.closers {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// downloadInventory copies an inventory file to a temporary file, as
+// columnar formats require random access
+func (a *Archive) downloadInventory(bucket *string, key string) (*os.File, int64, error) {
+	output, err := a.client.GetObject(&s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer output.Body.Close()
+	tmp, err := ioutil.TempFile("", "inventory")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(tmp, output.Body)
+	if err != nil {
+		removeTemp(tmp)
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// next returns the file's next relevant object, reading the file a batch of
+// rows at a time
+func (c *columnarInventory) next() (*s3.Object, error) {
+	for len(c.objects) == 0 {
+		values, err := c.read(inventoryColumnNames)
+		if err != nil {
+			return nil, err
+		}
+		c.append(values)
+	}
+	o := c.objects[0]
+	c.objects = c.objects[1:]
+	return o, nil
+}
+
+// append appends the relevant objects of a batch of rows
+func (c *columnarInventory) append(values [][]interface{}) {
+	for row := range values[1] {
+		value := func(column int) interface{} {
+			if row < len(values[column]) {
+				return values[column][row]
+			}
+			return nil
+		}
+		if v, ok := value(7).(bool); ok && v {
+			continue
+		}
+		if v, ok := value(6).(bool); ok && !v {
+			continue
+		}
+		if v, ok := value(0).(string); ok && v != c.bucket {
+			continue
+		}
+		k, ok := value(1).(string)
+		if !ok {
+			continue
+		}
+		o := &s3.Object{Key: aws.String(k)}
+		if v, ok := value(2).(int64); ok {
+			o.Size = aws.Int64(v)
+		}
+		if v, ok := value(3).(time.Time); ok {
+			o.LastModified = aws.Time(v)
+		}
+		if v, ok := value(4).(string); ok && v != "" {
+			o.ETag = aws.String(strconv.Quote(v))
+		}
+		if v, ok := value(5).(string); ok && v != "" {
+			o.StorageClass = aws.String(v)
+		}
+		c.objects = append(c.objects, o)
+	}
+}
+
+// openInventoryORC opens an orc inventory file
+func (a *Archive) openInventoryORC(bucket *string, key string) (*columnarInventory, error) {
+	tmp, size, err := a.downloadInventory(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	o, err := openOrc(tmp, size)
+	if err != nil {
+		removeTemp(tmp)
+		return nil, err
+	}
+	o.tmp = tmp
+	if _, ok := o.columns["key"]; !ok {
+		o.Close()
+		return nil, errors.New("inventory schema has no key column")
+	}
+	return &columnarInventory{inventoryColumns: o, bucket: *a.bucket}, nil
+}
+
+// openInventoryParquet opens a parquet inventory file
+func (a *Archive) openInventoryParquet(bucket *string, key string) (*columnarInventory, error) {
+	tmp, _, err := a.downloadInventory(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	p := &parquetInventory{tmp: tmp}
+	if p.reader, err = reader.NewParquetColumnReader(parquetSource{tmp}, 1); err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.rows = p.reader.GetNumRows()
+	if _, err := p.reader.SchemaHandler.ConvertToInPathStr(p.path("key")); err != nil {
+		p.Close()
+		return nil, errors.New("inventory schema has no key column")
+	}
+	return &columnarInventory{inventoryColumns: p, bucket: *a.bucket}, nil
+}
+
+// path returns the schema path of a column
+func (p *parquetInventory) path(column string) string {
+	return p.reader.SchemaHandler.GetRootExName() + common.PAR_GO_PATH_DELIMITER + column
+}
+
+// read reads the next batch of rows, treating absent optional columns as null
+func (p *parquetInventory) read(names []string) ([][]interface{}, error) {
+	if p.rows == 0 {
+		return nil, io.EOF
+	}
+	n := int64(inventoryRows)
+	if p.rows < n {
+		n = p.rows
+	}
+	p.rows -= n
+	values := make([][]interface{}, len(names))
+	for i, name := range names {
+		path := p.path(name)
+		if _, err := p.reader.SchemaHandler.ConvertToInPathStr(path); err != nil {
+			values[i] = make([]interface{}, n)
+			continue
+		}
+		var err error
+		if values[i], _, _, err = p.reader.ReadColumnByPath(path, n); err != nil {
+			return nil, err
+		}
+		// timestamps are stored as milliseconds
+		if name == "last_modified_date" {
+			for j, v := range values[i] {
+				if ms, ok := v.(int64); ok {
+					values[i][j] = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+// Close closes the file's column readers and removes its temporary copy
+func (p *parquetInventory) Close() error {
+	if p.reader != nil {
+		p.reader.ReadStop()
+	}
+	return removeTemp(p.tmp)
+}
+
+// removeTemp closes and removes a temporary copy of an inventory file
+func removeTemp(f *os.File) error {
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Open opens a new handle for the file
+func (s parquetSource) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = s.Name()
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return parquetSource{f}, nil
+}
+
+// Create fails, as the source is only read
+func (s parquetSource) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("parquet source is read only: " + name)
+}
@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ReadKeys reads an explicit list of archive keys, either one key per line or
+// csv rows of the form <bucket>,<key>. Rows for other buckets are skipped, so
+// that a single file can list the keys of several sources, and the number of
+// rows skipped is returned along with the keys.
+func ReadKeys(r io.Reader, bucket string) ([]string, int, error) {
+	keys := []string{}
+	skipped := 0
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	for {
+		row, err := c.Read()
+		if err == io.EOF {
+			return keys, skipped, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var key string
+		switch len(row) {
+		case 1:
+			key = row[0]
+		default:
+			if strings.TrimSpace(row[0]) != bucket {
+				skipped++
+				continue
+			}
+			key = row[1]
+		}
+		if key == "" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+}
+
+// scanKeys queues the configured list of keys in key order, skipping listing
+// but looking up each object's metadata so that the same prefix, time range
+// and filter rules apply
+func (a *Archive) scanKeys(pending chan *s3.Object) error {
+	keys := make([]string, len(a.keys))
+	copy(keys, a.keys)
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		if !a.listed(key) {
+			a.log.WithField("key", key).Debugln("skipping s3 key outside of prefix")
+			continue
+		}
+		output, err := a.headObject(aws.String(key), nil)
+		if err != nil {
+			a.log.WithError(err).WithField("key", key).Errorln("error reading s3 key metadata")
+			if a.reporter != nil {
+				a.reporter.Failed(*a.bucket, key, err)
+			}
+			continue
+		}
+		o := &s3.Object{
+			ETag:         output.ETag,
+			Key:          aws.String(key),
+			LastModified: output.LastModified,
+			Size:         output.ContentLength,
+			StorageClass: output.StorageClass,
+		}
+		if !a.queue(o, nil, pending) {
+			break
+		}
+	}
+	return nil
+}
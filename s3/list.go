@@ -0,0 +1,177 @@
+package s3
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listDelimiter is the delimiter used to discover sub-prefixes of the archive
+// prefix when listing concurrently
+const listDelimiter = "/"
+
+// listPages is the number of pages of each prefix that may be listed ahead
+// of the prefix currently being queued when listing concurrently
+const listPages = 100
+
+// segment describes a contiguous portion of the key space, either a prefix to
+// list or a single object found while discovering prefixes
+type segment struct {
+	object *s3.Object
+	prefix *string
+}
+
+// name returns the key or prefix that orders a segment within the key space
+func (s *segment) name() string {
+	if s.object != nil {
+		return *s.object.Key
+	}
+	return aws.StringValue(s.prefix)
+}
+
+// listing streams the pages of a single segment as they are listed
+type listing struct {
+	err   error
+	pages chan []*s3.Object
+}
+
+// scanListConcurrent splits the key space into segments and lists them
+// concurrently, queueing returned objects in global key order. At most list
+// concurrency segments are listed ahead of the segment being queued.
+func (a *Archive) scanListConcurrent(pending chan *s3.Object) error {
+	segments, err := a.split()
+	if err != nil {
+		return err
+	}
+	a.log.WithField("segments", len(segments)).Infoln("listing concurrently")
+	// stop any listings still in progress once the scan returns
+	done := make(chan struct{})
+	defer close(done)
+	// schedule segment listings in order, starting each as space in the
+	// queue becomes available
+	listings := make(chan *listing, a.listConcurrency)
+	go func() {
+		defer close(listings)
+		for _, s := range segments {
+			l := &listing{pages: make(chan []*s3.Object, listPages)}
+			select {
+			case listings <- l:
+			case <-done:
+				return
+			}
+			if s.object != nil {
+				l.pages <- []*s3.Object{s.object}
+				close(l.pages)
+				continue
+			}
+			go a.listSegment(s.prefix, l, done)
+		}
+	}()
+	for l := range listings {
+		for page := range l.pages {
+			for _, o := range page {
+				if !a.queue(o, nil, pending) {
+					return nil
+				}
+			}
+		}
+		if l.err != nil {
+			return l.err
+		}
+	}
+	return nil
+}
+
+// listSegment lists the objects beneath a prefix after the start key,
+// streaming each page until the listing completes or the scan is done
+func (a *Archive) listSegment(prefix *string, l *listing, done chan struct{}) {
+	defer close(l.pages)
+	params := &s3.ListObjectsV2Input{
+		Bucket:       a.bucket,
+		Prefix:       prefix,
+		RequestPayer: a.requestPayer,
+		StartAfter:   a.startAfter,
+	}
+	l.err = a.client.ListObjectsV2Pages(params, func(output *s3.ListObjectsV2Output, more bool) bool {
+		select {
+		case l.pages <- output.Contents:
+			return true
+		case <-done:
+			return false
+		}
+	})
+}
+
+// split divides the key space into ordered segments, using the time range
+// prefixes if configured, otherwise discovering sub-prefixes of the archive
+// prefix level by level until there are at least as many segments as the
+// list concurrency
+func (a *Archive) split() ([]*segment, error) {
+	segments := []*segment{}
+	if len(a.prefixes) > 0 {
+		for _, prefix := range a.prefixes {
+			segments = append(segments, &segment{prefix: prefix})
+		}
+		return segments, nil
+	}
+	segments = append(segments, &segment{prefix: aws.String(aws.StringValue(a.prefix))})
+	for len(segments) < a.listConcurrency {
+		expanded := []*segment{}
+		found := false
+		for _, s := range segments {
+			if s.object != nil {
+				expanded = append(expanded, s)
+				continue
+			}
+			children, err := a.discover(s.prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				found = found || child.prefix != nil
+			}
+			expanded = append(expanded, children...)
+		}
+		segments = expanded
+		if !found {
+			break
+		}
+	}
+	return segments, nil
+}
+
+// discover lists the objects and sub-prefixes immediately beneath a prefix,
+// returning them in key order and omitting any that end before the start key
+func (a *Archive) discover(prefix *string) ([]*segment, error) {
+	segments := []*segment{}
+	params := &s3.ListObjectsV2Input{
+		Bucket:       a.bucket,
+		Delimiter:    aws.String(listDelimiter),
+		Prefix:       prefix,
+		RequestPayer: a.requestPayer,
+	}
+	err := a.client.ListObjectsV2Pages(params, func(output *s3.ListObjectsV2Output, more bool) bool {
+		for _, o := range output.Contents {
+			if a.startAfter == nil || *o.Key > *a.startAfter {
+				segments = append(segments, &segment{object: o})
+			}
+		}
+		for _, p := range output.CommonPrefixes {
+			if a.startAfter == nil || *a.startAfter < *p.Prefix || strings.HasPrefix(*a.startAfter, *p.Prefix) {
+				segments = append(segments, &segment{prefix: p.Prefix})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// an object that is not beneath a sub-prefix sorts entirely before or
+	// after all of its keys
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].name() < segments[j].name()
+	})
+	return segments, nil
+}
@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"fmt"
+	"s3-kinesis-replay/mock"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	mocks "github.com/stretchr/testify/mock"
+)
+
+// listClient returns a mock s3 client that lists the given keys two at a
+// time, honouring the prefix, delimiter and start after parameters
+func listClient(keys []string) *mock.S3API {
+	sort.Strings(keys)
+	client := &mock.S3API{}
+	client.On("ListObjectsV2Pages", mocks.AnythingOfType("*s3.ListObjectsV2Input"), mocks.AnythingOfType("func(*s3.ListObjectsV2Output, bool) bool")).
+		Run(func(args mocks.Arguments) {
+			in := args.Get(0).(*s3.ListObjectsV2Input)
+			cb := args.Get(1).(func(*s3.ListObjectsV2Output, bool) bool)
+			prefix, delimiter := aws.StringValue(in.Prefix), aws.StringValue(in.Delimiter)
+			pages := []*s3.ListObjectsV2Output{{}}
+			seen := map[string]bool{}
+			for _, key := range keys {
+				if !strings.HasPrefix(key, prefix) || key <= aws.StringValue(in.StartAfter) {
+					continue
+				}
+				page := pages[len(pages)-1]
+				if len(page.Contents)+len(page.CommonPrefixes) == 2 {
+					page = &s3.ListObjectsV2Output{}
+					pages = append(pages, page)
+				}
+				if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+					p := key[:len(prefix)+i+1]
+					if !seen[p] {
+						seen[p] = true
+						page.CommonPrefixes = append(page.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+					}
+					continue
+				}
+				page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+			}
+			for i, page := range pages {
+				if !cb(page, i < len(pages)-1) {
+					return
+				}
+			}
+		}).
+		Return(nil)
+	return client
+}
+
+func TestScanListConcurrent(t *testing.T) {
+	keys := []string{"stream/a.json", "stream/z.json"}
+	for _, day := range []string{"01", "02", "03"} {
+		for hour := 0; hour < 4; hour++ {
+			for i := 0; i < 3; i++ {
+				keys = append(keys, fmt.Sprintf("stream/2018/01/%s/%02d/object-%d", day, hour, i))
+			}
+		}
+	}
+	keys = append(keys, "stream/2018/01/02.json", "stream/2018/01/02/zz")
+
+	scan := func(concurrency int, startAfter, stopAt string) []string {
+		config := NewArchiveConfig()
+		config.Bucket = "foo"
+		config.Client = listClient(append([]string{}, keys...))
+		config.ListConcurrency = concurrency
+		config.Prefix = "stream/"
+		config.StartAfter = startAfter
+		config.StopAt = stopAt
+		archive, err := NewArchive(config)
+		assert.Nil(t, err)
+		pending := make(chan *s3.Object, len(keys))
+		archive.scan(pending)
+		queued := []string{}
+		for o := range pending {
+			queued = append(queued, *o.Key)
+		}
+		return queued
+	}
+
+	// expect the same global key order as a serial listing
+	for _, tc := range []struct {
+		startAfter string
+		stopAt     string
+	}{
+		{"", ""},
+		{"stream/2018/01/02/01/object-1", ""},
+		{"stream/2018/01/02", "stream/2018/01/03/01/object-0"},
+	} {
+		expected := scan(1, tc.startAfter, tc.stopAt)
+		assert.NotEmpty(t, expected)
+		for _, concurrency := range []int{2, 8, 64} {
+			assert.Equal(t, expected, scan(concurrency, tc.startAfter, tc.stopAt))
+		}
+	}
+}
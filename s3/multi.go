@@ -0,0 +1,127 @@
+package s3
+
+import (
+	"errors"
+	"s3-kinesis-replay/replay"
+	"s3-kinesis-replay/validate"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+)
+
+// supported multi-source ordering modes
+const (
+	// OrderInterleaved merges objects from all sources by the timestamp in
+	// their keys, falling back to their last modified time
+	OrderInterleaved = "interleaved"
+	// OrderSequential replays each source in its entirety before the next
+	OrderSequential = "sequential"
+)
+
+// MultiArchive implements an archive that merges the objects of multiple
+// archive sources into a single stream
+type MultiArchive struct {
+	archives []replay.Archive
+	log      logrus.FieldLogger
+	order    string
+}
+
+// NewMultiArchive returns a new multi-source archive
+func NewMultiArchive(c *MultiArchiveConfig) (*MultiArchive, error) {
+	// validate configuration
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Order != OrderInterleaved && c.Order != OrderSequential {
+		return nil, errors.New("invalid source order: " + c.Order)
+	}
+	m := &MultiArchive{
+		archives: c.Archives,
+		log:      c.Log,
+		order:    c.Order,
+	}
+	return m, nil
+}
+
+// Scan scans each archive source, emitting their objects on the returned
+// channel in the configured order
+func (m *MultiArchive) Scan() chan *replay.Object {
+	objects := make(chan *replay.Object)
+	if m.order == OrderSequential {
+		go m.sequential(objects)
+	} else {
+		go m.interleaved(objects)
+	}
+	return objects
+}
+
+// sequential forwards the objects of each source in turn, only scanning a
+// source once the previous source has been exhausted
+func (m *MultiArchive) sequential(objects chan *replay.Object) {
+	for i, archive := range m.archives {
+		m.log.WithField("source", i).Infoln("scanning source")
+		for o := range archive.Scan() {
+			objects <- o
+		}
+	}
+	close(objects)
+}
+
+// interleaved scans all sources concurrently, repeatedly emitting the
+// earliest object from the heads of the source streams
+func (m *MultiArchive) interleaved(objects chan *replay.Object) {
+	streams := make([]chan *replay.Object, len(m.archives))
+	heads := make([]*replay.Object, len(m.archives))
+	for i, archive := range m.archives {
+		streams[i] = archive.Scan()
+		heads[i] = <-streams[i]
+	}
+	for {
+		next := -1
+		for i, head := range heads {
+			if head == nil {
+				continue
+			}
+			if next == -1 || objectTime(head).Before(objectTime(heads[next])) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+		objects <- heads[next]
+		heads[next] = <-streams[next]
+	}
+	close(objects)
+}
+
+// objectTime returns the firehose delivery timestamp in an object's key,
+// falling back to its last modified time
+func objectTime(o *replay.Object) time.Time {
+	if t, ok := keyTime(aws.StringValue(o.Object.Key)); ok {
+		return t
+	}
+	return aws.TimeValue(o.Object.LastModified)
+}
+
+// MultiArchiveConfig defines a multi-source archive configuration
+type MultiArchiveConfig struct {
+	// The archive sources to merge
+	Archives []replay.Archive `validate:"required,min=1"`
+	// An optional archive scoped logger
+	Log logrus.FieldLogger `validate:"required"`
+	// The order in which objects from different sources are emitted, either
+	// interleaved or sequential
+	Order string `validate:"required"`
+}
+
+// NewMultiArchiveConfig returns a multi-source archive config value with
+// appropriate defaults
+func NewMultiArchiveConfig() *MultiArchiveConfig {
+	return &MultiArchiveConfig{
+		Log:   logrus.WithField("package", "s3"),
+		Order: OrderInterleaved,
+	}
+}
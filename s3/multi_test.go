@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"s3-kinesis-replay/replay"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticArchive is an archive that emits a fixed set of keys
+type staticArchive []string
+
+func (a staticArchive) Scan() chan *replay.Object {
+	objects := make(chan *replay.Object, len(a))
+	for _, key := range a {
+		objects <- &replay.Object{Object: &s3.Object{Key: aws.String(key)}}
+	}
+	close(objects)
+	return objects
+}
+
+func TestMultiArchiveOrder(t *testing.T) {
+	east := staticArchive{"s-1-2018-01-03-04-00-00-a", "s-1-2018-01-03-04-20-00-a"}
+	west := staticArchive{"s-1-2018-01-03-04-10-00-b", "s-1-2018-01-03-04-30-00-b"}
+	testcases := []*struct {
+		order    string
+		expected []string
+	}{
+		{OrderInterleaved, []string{east[0], west[0], east[1], west[1]}},
+		{OrderSequential, []string{east[0], east[1], west[0], west[1]}},
+	}
+	for _, testcase := range testcases {
+		archive, err := NewMultiArchive(&MultiArchiveConfig{
+			Archives: []replay.Archive{east, west},
+			Log:      logrus.WithField("test", true),
+			Order:    testcase.order,
+		})
+		assert.Nil(t, err)
+		keys := []string{}
+		for o := range archive.Scan() {
+			keys = append(keys, *o.Object.Key)
+		}
+		assert.Equal(t, testcase.expected, keys)
+	}
+}
@@ -0,0 +1,971 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// orcMagic begins every orc file and ends its postscript
+const orcMagic = "ORC"
+
+// orcMaxMetadata limits the decompressed size of an orc file or stripe
+// footer
+const orcMaxMetadata = 64 << 20
+
+// orcMaxBlock limits the size of an orc compression chunk
+const orcMaxBlock = 16 << 20
+
+// orc compression kinds
+const (
+	orcNone   = 0
+	orcZlib   = 1
+	orcSnappy = 2
+	orcZstd   = 5
+)
+
+// orc type kinds
+const (
+	orcBoolean   = 0
+	orcShort     = 2
+	orcInt       = 3
+	orcLong      = 4
+	orcString    = 7
+	orcBinary    = 8
+	orcTimestamp = 9
+	orcStruct    = 12
+	orcVarchar   = 16
+	orcChar      = 17
+)
+
+// orc stream kinds
+const (
+	orcPresent        = 0
+	orcData           = 1
+	orcLength         = 2
+	orcDictionaryData = 3
+	orcSecondary      = 5
+)
+
+// orc column encodings
+const (
+	orcDirect       = 0
+	orcDictionary   = 1
+	orcDirectV2     = 2
+	orcDictionaryV2 = 3
+)
+
+// errMalformedOrc is returned when an orc file cannot be decoded
+var errMalformedOrc = errors.New("malformed orc file")
+
+// orcInventory reads the columns of an orc inventory file, whose top-level
+// struct fields are its columns, a stripe at a time
+type orcInventory struct {
+	blockSize int64
+	codec     uint64
+	columns   map[string]*orcColumn
+	r         io.ReaderAt
+	size      int64
+	stripes   []orcMessage
+	tmp       *os.File
+	// the current stripe's remaining rows and column readers
+	stripe  int
+	rows    int64
+	readers map[string]*orcColumnReader
+}
+
+// orcColumn describes a top-level column
+type orcColumn struct {
+	id   uint64
+	kind uint64
+}
+
+// orcColumnReader reads the values of a column in a stripe
+type orcColumnReader struct {
+	// present is nil when the column has no nulls
+	present *orcBools
+	value   func() (interface{}, error)
+}
+
+// orcMessage holds the fields of a protobuf message, with varints as uint64
+// values and length delimited fields as []byte values
+type orcMessage map[uint64][]interface{}
+
+// orcInts reads a run length encoded integer stream
+type orcInts interface {
+	next() (int64, error)
+}
+
+// orcRLEv1 reads version 1 run length encoded integers
+type orcRLEv1 struct {
+	r        *bufio.Reader
+	signed   bool
+	literals int
+	run      int
+	value    int64
+	delta    int64
+}
+
+// orcRLEv2 reads version 2 run length encoded integers a run at a time
+type orcRLEv2 struct {
+	r      *bufio.Reader
+	signed bool
+	values []int64
+}
+
+// orcBytes reads run length encoded bytes
+type orcBytes struct {
+	r        *bufio.Reader
+	literals int
+	run      int
+	value    byte
+}
+
+// orcBools reads booleans packed into run length encoded bytes
+type orcBools struct {
+	bytes orcBytes
+	bits  uint
+	b     byte
+}
+
+// orcChunks decompresses a stream of compression chunks
+type orcChunks struct {
+	blockSize int64
+	buf       []byte
+	codec     uint64
+	r         io.Reader
+}
+
+// openOrc decodes the postscript and footer at the end of an orc file
+func openOrc(r io.ReaderAt, size int64) (*orcInventory, error) {
+	// the postscript's length is held in the file's last byte
+	tail := make([]byte, 256)
+	if size < int64(len(tail)) {
+		tail = tail[:size]
+	}
+	if len(tail) < len(orcMagic)+1 {
+		return nil, errors.New("not an orc file")
+	}
+	if _, err := r.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return nil, err
+	}
+	l := int(tail[len(tail)-1])
+	if l+1 > len(tail) {
+		return nil, errMalformedOrc
+	}
+	ps, err := parseOrcMessage(tail[len(tail)-1-l : len(tail)-1])
+	if err != nil || string(ps.bytes(8000)) != orcMagic {
+		return nil, errors.New("not an orc file")
+	}
+	o := &orcInventory{
+		blockSize: int64(ps.uint(3)),
+		codec:     ps.uint(2),
+		columns:   map[string]*orcColumn{},
+		r:         r,
+		size:      size,
+	}
+	switch o.codec {
+	case orcNone, orcZlib, orcSnappy, orcZstd:
+	default:
+		return nil, fmt.Errorf("unsupported orc compression kind %d", o.codec)
+	}
+	if o.blockSize == 0 {
+		o.blockSize = 256 << 10
+	}
+	if o.blockSize > orcMaxBlock {
+		return nil, errMalformedOrc
+	}
+	// the footer precedes the postscript
+	end := size - int64(l) - 1
+	footer, err := o.message(end-int64(ps.uint(1)), ps.uint(1), end)
+	if err != nil {
+		return nil, err
+	}
+	types, err := footer.messages(4)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 || types[0].uint(1) != orcStruct {
+		return nil, errors.New("orc schema is not a struct")
+	}
+	fields, err := types[0].uints(2)
+	if err != nil {
+		return nil, err
+	}
+	names := types[0][3]
+	if len(fields) != len(names) {
+		return nil, errMalformedOrc
+	}
+	for i, id := range fields {
+		name, ok := names[i].([]byte)
+		if !ok || id >= uint64(len(types)) {
+			return nil, errMalformedOrc
+		}
+		o.columns[string(name)] = &orcColumn{id: id, kind: types[id].uint(1)}
+	}
+	if o.stripes, err = footer.messages(3); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// read reads the next batch of rows from the current stripe, moving to the
+// next stripe once it is read
+func (o *orcInventory) read(names []string) ([][]interface{}, error) {
+	for o.rows == 0 {
+		if o.stripe == len(o.stripes) {
+			return nil, io.EOF
+		}
+		if err := o.openStripe(names); err != nil {
+			return nil, err
+		}
+	}
+	n := int64(inventoryRows)
+	if o.rows < n {
+		n = o.rows
+	}
+	o.rows -= n
+	values := make([][]interface{}, len(names))
+	for i, name := range names {
+		c, ok := o.readers[name]
+		if !ok {
+			values[i] = make([]interface{}, n)
+			continue
+		}
+		var err error
+		if values[i], err = c.read(int(n)); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Close removes the file's temporary copy
+func (o *orcInventory) Close() error {
+	return removeTemp(o.tmp)
+}
+
+// openStripe decodes the next stripe's footer and opens the streams of the
+// named columns
+func (o *orcInventory) openStripe(names []string) error {
+	s := o.stripes[o.stripe]
+	o.stripe++
+	offset, index, data, length := s.uint(1), s.uint(2), s.uint(3), s.uint(4)
+	if offset > uint64(o.size) || index > uint64(o.size) || data > uint64(o.size) || offset+index+data > uint64(o.size) {
+		return errMalformedOrc
+	}
+	footer, err := o.message(int64(offset+index+data), length, o.size)
+	if err != nil {
+		return err
+	}
+	streams, err := footer.messages(1)
+	if err != nil {
+		return err
+	}
+	encodings, err := footer.messages(2)
+	if err != nil {
+		return err
+	}
+	// timestamps are relative to the start of 2015 in the writer's timezone
+	location := time.UTC
+	if tz := string(footer.bytes(3)); tz != "" {
+		if location, err = time.LoadLocation(tz); err != nil {
+			return err
+		}
+	}
+	// streams are stored consecutively from the start of the stripe
+	type key struct{ column, kind uint64 }
+	sections := map[key]*io.SectionReader{}
+	pos := offset
+	for _, stream := range streams {
+		l := stream.uint(3)
+		if l > offset+index+data-pos {
+			return errMalformedOrc
+		}
+		sections[key{stream.uint(2), stream.uint(1)}] = io.NewSectionReader(o.r, int64(pos), int64(l))
+		pos += l
+	}
+	open := func(column, kind uint64) *bufio.Reader {
+		section, ok := sections[key{column, kind}]
+		if !ok {
+			return nil
+		}
+		if o.codec == orcNone {
+			return bufio.NewReader(section)
+		}
+		return bufio.NewReader(&orcChunks{blockSize: o.blockSize, codec: o.codec, r: section})
+	}
+	o.readers = map[string]*orcColumnReader{}
+	for _, name := range names {
+		column, ok := o.columns[name]
+		if !ok {
+			continue
+		}
+		if column.id >= uint64(len(encodings)) {
+			return errMalformedOrc
+		}
+		encoding := encodings[column.id]
+		c, err := newOrcColumnReader(column, encoding.uint(1), encoding.uint(2), location, func(kind uint64) *bufio.Reader {
+			return open(column.id, kind)
+		})
+		if err != nil {
+			return fmt.Errorf("orc column %s: %v", name, err)
+		}
+		o.readers[name] = c
+	}
+	if o.rows = int64(s.uint(5)); o.rows < 0 {
+		return errMalformedOrc
+	}
+	return nil
+}
+
+// message reads a compressed protobuf message of length bytes at offset,
+// which must end before end
+func (o *orcInventory) message(offset int64, length uint64, end int64) (orcMessage, error) {
+	if offset < 0 || length > uint64(end-offset) {
+		return nil, errMalformedOrc
+	}
+	var r io.Reader = io.NewSectionReader(o.r, offset, int64(length))
+	if o.codec != orcNone {
+		r = &orcChunks{blockSize: o.blockSize, codec: o.codec, r: r}
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, orcMaxMetadata+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > orcMaxMetadata {
+		return nil, errMalformedOrc
+	}
+	return parseOrcMessage(b)
+}
+
+// newOrcColumnReader opens the streams of a column in a stripe
+func newOrcColumnReader(column *orcColumn, encoding, dictionarySize uint64, location *time.Location, open func(kind uint64) *bufio.Reader) (*orcColumnReader, error) {
+	c := &orcColumnReader{}
+	if present := open(orcPresent); present != nil {
+		c.present = &orcBools{bytes: orcBytes{r: present}}
+	}
+	data := open(orcData)
+	if data == nil {
+		return nil, errMalformedOrc
+	}
+	ints := func(r *bufio.Reader, signed bool) (orcInts, error) {
+		if r == nil {
+			return nil, errMalformedOrc
+		}
+		switch encoding {
+		case orcDirect, orcDictionary:
+			return &orcRLEv1{r: r, signed: signed}, nil
+		case orcDirectV2, orcDictionaryV2:
+			return &orcRLEv2{r: r, signed: signed}, nil
+		}
+		return nil, fmt.Errorf("unsupported encoding %d", encoding)
+	}
+	switch column.kind {
+	case orcBoolean:
+		bools := &orcBools{bytes: orcBytes{r: data}}
+		c.value = func() (interface{}, error) {
+			return bools.next()
+		}
+	case orcShort, orcInt, orcLong:
+		values, err := ints(data, true)
+		if err != nil {
+			return nil, err
+		}
+		c.value = func() (interface{}, error) {
+			return values.next()
+		}
+	case orcString, orcBinary, orcVarchar, orcChar:
+		lengths, err := ints(open(orcLength), false)
+		if err != nil {
+			return nil, err
+		}
+		if encoding == orcDirect || encoding == orcDirectV2 {
+			c.value = func() (interface{}, error) {
+				return readOrcString(data, lengths)
+			}
+			break
+		}
+		// dictionary entries are distinct, so only one may be empty and
+		// the dictionary cannot outgrow its data
+		dictionary := []interface{}{}
+		entries := open(orcDictionaryData)
+		empty := false
+		for i := uint64(0); i < dictionarySize; i++ {
+			v, err := readOrcString(entries, lengths)
+			if err != nil {
+				return nil, orcEOF(err)
+			}
+			if v == "" {
+				if empty {
+					return nil, errMalformedOrc
+				}
+				empty = true
+			}
+			dictionary = append(dictionary, v)
+		}
+		indexes, err := ints(data, false)
+		if err != nil {
+			return nil, err
+		}
+		c.value = func() (interface{}, error) {
+			i, err := indexes.next()
+			if err != nil {
+				return nil, err
+			}
+			if i < 0 || i >= int64(len(dictionary)) {
+				return nil, errMalformedOrc
+			}
+			return dictionary[i], nil
+		}
+	case orcTimestamp:
+		seconds, err := ints(data, true)
+		if err != nil {
+			return nil, err
+		}
+		nanos, err := ints(open(orcSecondary), false)
+		if err != nil {
+			return nil, err
+		}
+		base := time.Date(2015, 1, 1, 0, 0, 0, 0, location).Unix()
+		c.value = func() (interface{}, error) {
+			s, err := seconds.next()
+			if err != nil {
+				return nil, err
+			}
+			n, err := nanos.next()
+			if err != nil {
+				return nil, err
+			}
+			// the low 3 bits of the nanoseconds count their trailing zeros
+			// beyond the first
+			zeros := n & 7
+			n >>= 3
+			if zeros > 0 {
+				for i := int64(0); i <= zeros; i++ {
+					n *= 10
+				}
+			}
+			s += base
+			if s < 0 && n > 999999 {
+				s--
+			}
+			return time.Unix(s, n).UTC(), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %d", column.kind)
+	}
+	return c, nil
+}
+
+// readOrcString reads a string whose length is read from a length stream
+func readOrcString(data *bufio.Reader, lengths orcInts) (interface{}, error) {
+	if data == nil {
+		return nil, errMalformedOrc
+	}
+	l, err := lengths.next()
+	if err != nil {
+		return nil, err
+	}
+	if l < 0 {
+		return nil, errMalformedOrc
+	}
+	// grow with the bytes read rather than the length read
+	var b bytes.Buffer
+	if n, err := io.CopyN(&b, data, l); n < l {
+		if err == io.EOF {
+			err = errMalformedOrc
+		}
+		return nil, err
+	}
+	return b.String(), nil
+}
+
+// read reads n values, with nil values for nulls
+func (c *orcColumnReader) read(n int) ([]interface{}, error) {
+	values := make([]interface{}, n)
+	for i := range values {
+		if c.present != nil {
+			present, err := c.present.next()
+			if err != nil {
+				return nil, orcEOF(err)
+			}
+			if !present {
+				continue
+			}
+		}
+		var err error
+		if values[i], err = c.value(); err != nil {
+			return nil, orcEOF(err)
+		}
+	}
+	return values, nil
+}
+
+// orcEOF reports a stream that ends before its column's rows are read as
+// malformed
+func orcEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errMalformedOrc
+	}
+	return err
+}
+
+// parseOrcMessage decodes the fields of a protobuf message
+func parseOrcMessage(b []byte) (orcMessage, error) {
+	m := orcMessage{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errMalformedOrc
+		}
+		b = b[n:]
+		field := key >> 3
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errMalformedOrc
+			}
+			m[field] = append(m[field], v)
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, errMalformedOrc
+			}
+			m[field] = append(m[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return nil, errMalformedOrc
+			}
+			m[field] = append(m[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, errMalformedOrc
+			}
+			m[field] = append(m[field], uint64(binary.LittleEndian.Uint32(b)))
+			b = b[4:]
+		default:
+			return nil, errMalformedOrc
+		}
+	}
+	return m, nil
+}
+
+// uint returns an integer field, or 0 if it is not set
+func (m orcMessage) uint(field uint64) uint64 {
+	values := m[field]
+	if len(values) == 0 {
+		return 0
+	}
+	v, _ := values[len(values)-1].(uint64)
+	return v
+}
+
+// bytes returns a length delimited field, or nil if it is not set
+func (m orcMessage) bytes(field uint64) []byte {
+	values := m[field]
+	if len(values) == 0 {
+		return nil
+	}
+	v, _ := values[len(values)-1].([]byte)
+	return v
+}
+
+// uints returns a repeated integer field, which may be packed
+func (m orcMessage) uints(field uint64) ([]uint64, error) {
+	var values []uint64
+	for _, v := range m[field] {
+		switch v := v.(type) {
+		case uint64:
+			values = append(values, v)
+		case []byte:
+			for len(v) > 0 {
+				u, n := binary.Uvarint(v)
+				if n <= 0 {
+					return nil, errMalformedOrc
+				}
+				values = append(values, u)
+				v = v[n:]
+			}
+		}
+	}
+	return values, nil
+}
+
+// messages returns a repeated message field
+func (m orcMessage) messages(field uint64) ([]orcMessage, error) {
+	var messages []orcMessage
+	for _, v := range m[field] {
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, errMalformedOrc
+		}
+		message, err := parseOrcMessage(b)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// next returns the next integer of a run or literal list
+func (r *orcRLEv1) next() (int64, error) {
+	if r.literals == 0 && r.run == 0 {
+		control, err := r.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if control >= 0x80 {
+			r.literals = 0x100 - int(control)
+		} else {
+			// runs add a signed byte delta to a base value
+			delta, err := r.r.ReadByte()
+			if err != nil {
+				return 0, orcEOF(err)
+			}
+			base, err := orcVarint(r.r, r.signed)
+			if err != nil {
+				return 0, err
+			}
+			r.run = int(control) + 3
+			r.delta = int64(int8(delta))
+			r.value = base - r.delta
+		}
+	}
+	if r.literals > 0 {
+		r.literals--
+		return orcVarint(r.r, r.signed)
+	}
+	r.run--
+	r.value += r.delta
+	return r.value, nil
+}
+
+// next returns the next integer, decoding the next run when the current run
+// is read
+func (r *orcRLEv2) next() (int64, error) {
+	if len(r.values) == 0 {
+		if err := r.decode(); err != nil {
+			return 0, err
+		}
+	}
+	v := r.values[0]
+	r.values = r.values[1:]
+	return v, nil
+}
+
+// decode decodes a short repeat, direct, patched base or delta run
+func (r *orcRLEv2) decode() error {
+	header, err := r.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	sign := func(u uint64) int64 {
+		if r.signed {
+			return int64(u>>1) ^ -int64(u&1)
+		}
+		return int64(u)
+	}
+	if header>>6 == 0 {
+		// a value of up to 8 bytes repeated 3 to 10 times
+		v, err := orcBigEndian(r.r, int(header>>3&7)+1)
+		if err != nil {
+			return err
+		}
+		r.values = make([]int64, int(header&7)+3)
+		for i := range r.values {
+			r.values[i] = sign(v)
+		}
+		return nil
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return orcEOF(err)
+	}
+	width := orcWidth(header >> 1 & 0x1f)
+	n := int(header&1)<<8 | int(b) + 1
+	switch header >> 6 {
+	case 1:
+		// bit packed values
+		values, err := orcPacked(r.r, n, width)
+		if err != nil {
+			return err
+		}
+		r.values = make([]int64, n)
+		for i, v := range values {
+			r.values[i] = sign(v)
+		}
+	case 2:
+		// bit packed offsets from a base value, whose outliers have their
+		// high bits patched
+		extra := make([]byte, 2)
+		if _, err := io.ReadFull(r.r, extra); err != nil {
+			return orcEOF(err)
+		}
+		baseWidth := int(extra[0]>>5) + 1
+		patchWidth := orcWidth(extra[0] & 0x1f)
+		gapWidth := int(extra[1]>>5) + 1
+		patches := int(extra[1] & 0x1f)
+		if patchWidth+gapWidth > 64 {
+			return errMalformedOrc
+		}
+		u, err := orcBigEndian(r.r, baseWidth)
+		if err != nil {
+			return err
+		}
+		// the base value's most significant bit is its sign
+		msb := uint64(1) << uint(baseWidth*8-1)
+		base := int64(u &^ msb)
+		if u&msb != 0 {
+			base = -base
+		}
+		values, err := orcPacked(r.r, n, width)
+		if err != nil {
+			return err
+		}
+		list, err := orcPacked(r.r, patches, orcClosestWidth(patchWidth+gapWidth))
+		if err != nil {
+			return err
+		}
+		pos := 0
+		for _, entry := range list {
+			pos += int(entry >> uint(patchWidth))
+			patch := entry & (1<<uint(patchWidth) - 1)
+			// gaps beyond 255 are split across entries without a patch
+			if patch == 0 {
+				continue
+			}
+			if pos >= n {
+				return errMalformedOrc
+			}
+			values[pos] |= patch << uint(width)
+		}
+		r.values = make([]int64, n)
+		for i, v := range values {
+			r.values[i] = base + int64(v)
+		}
+	case 3:
+		// a base value followed by deltas, which are fixed when their width
+		// is 0
+		if header>>1&0x1f == 0 {
+			width = 0
+		}
+		u, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return orcEOF(err)
+		}
+		delta, err := orcVarint(r.r, true)
+		if err != nil {
+			return err
+		}
+		r.values = []int64{sign(u)}
+		if n > 1 {
+			r.values = append(r.values, r.values[0]+delta)
+		}
+		if width == 0 {
+			for len(r.values) < n {
+				r.values = append(r.values, r.values[len(r.values)-1]+delta)
+			}
+			return nil
+		}
+		deltas, err := orcPacked(r.r, n-2, width)
+		if err != nil {
+			return err
+		}
+		for _, d := range deltas {
+			v := r.values[len(r.values)-1]
+			if delta < 0 {
+				v -= int64(d)
+			} else {
+				v += int64(d)
+			}
+			r.values = append(r.values, v)
+		}
+	}
+	return nil
+}
+
+// next returns the next byte of a run or literal list
+func (r *orcBytes) next() (byte, error) {
+	if r.literals == 0 && r.run == 0 {
+		control, err := r.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if control >= 0x80 {
+			r.literals = 0x100 - int(control)
+		} else {
+			if r.value, err = r.r.ReadByte(); err != nil {
+				return 0, orcEOF(err)
+			}
+			r.run = int(control) + 3
+		}
+	}
+	if r.literals > 0 {
+		r.literals--
+		b, err := r.r.ReadByte()
+		return b, orcEOF(err)
+	}
+	r.run--
+	return r.value, nil
+}
+
+// next returns the next boolean, most significant bit first
+func (r *orcBools) next() (bool, error) {
+	if r.bits == 0 {
+		b, err := r.bytes.next()
+		if err != nil {
+			return false, err
+		}
+		r.b = b
+		r.bits = 8
+	}
+	r.bits--
+	return r.b>>r.bits&1 == 1, nil
+}
+
+// Read reads decompressed bytes, decompressing the next chunk once the
+// current chunk is read
+func (c *orcChunks) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		// each chunk has a 3 byte little endian header holding its length and
+		// whether it is stored uncompressed in its lowest bit
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errMalformedOrc
+			}
+			return 0, err
+		}
+		h := int64(header[0]) | int64(header[1])<<8 | int64(header[2])<<16
+		l := h >> 1
+		if l > c.blockSize {
+			return 0, errMalformedOrc
+		}
+		chunk := make([]byte, l)
+		if _, err := io.ReadFull(c.r, chunk); err != nil {
+			return 0, orcEOF(err)
+		}
+		if h&1 == 1 {
+			c.buf = chunk
+			continue
+		}
+		var err error
+		if c.buf, err = c.decompress(chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// decompress decompresses a chunk, which must not exceed the block size
+func (c *orcChunks) decompress(chunk []byte) ([]byte, error) {
+	var r io.Reader
+	switch c.codec {
+	case orcZlib:
+		f := flate.NewReader(bytes.NewReader(chunk))
+		defer f.Close()
+		r = f
+	case orcSnappy:
+		if l, err := snappy.DecodedLen(chunk); err != nil || int64(l) > c.blockSize {
+			return nil, errMalformedOrc
+		}
+		return snappy.Decode(nil, chunk)
+	case orcZstd:
+		d, err := zstd.NewReader(bytes.NewReader(chunk), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, c.blockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > c.blockSize {
+		return nil, errMalformedOrc
+	}
+	return b, nil
+}
+
+// orcVarint reads a base 128 varint, which is zigzag encoded if signed
+func orcVarint(r io.ByteReader, signed bool) (int64, error) {
+	u, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, orcEOF(err)
+	}
+	if signed {
+		return int64(u>>1) ^ -int64(u&1), nil
+	}
+	return int64(u), nil
+}
+
+// orcBigEndian reads an unsigned big endian integer of n bytes
+func orcBigEndian(r io.ByteReader, n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, orcEOF(err)
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// orcPacked reads n unsigned integers of width bits, packed most significant
+// bit first and padded to a whole byte
+func orcPacked(r io.Reader, n, width int) ([]uint64, error) {
+	b := make([]byte, (n*width+7)/8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, orcEOF(err)
+	}
+	values := make([]uint64, n)
+	bit := 0
+	for i := range values {
+		for j := 0; j < width; j++ {
+			values[i] = values[i]<<1 | uint64(b[bit/8]>>uint(7-bit%8)&1)
+			bit++
+		}
+	}
+	return values, nil
+}
+
+// orcWidth decodes a 5 bit encoded bit width
+func orcWidth(code byte) int {
+	if code < 24 {
+		return int(code) + 1
+	}
+	return []int{26, 28, 30, 32, 40, 48, 56, 64}[code-24]
+}
+
+// orcClosestWidth rounds a bit width up to one that can be encoded
+func orcClosestWidth(width int) int {
+	if width <= 24 {
+		return width
+	}
+	for _, w := range []int{26, 28, 30, 32, 40, 48, 56} {
+		if width <= w {
+			return w
+		}
+	}
+	return 64
+}
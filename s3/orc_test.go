@@ -0,0 +1,99 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrcRLE(t *testing.T) {
+	// the examples of the orc specification
+	testcases := []*struct {
+		name     string
+		ints     func(r *bufio.Reader) orcInts
+		encoded  []byte
+		expected []int64
+	}{
+		{
+			name:     "v1 run",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv1{r: r} },
+			encoded:  []byte{0x61, 0x00, 0x07},
+			expected: []int64{7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7},
+		},
+		{
+			name:     "v1 delta run",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv1{r: r} },
+			encoded:  []byte{0x00, 0xff, 0x05},
+			expected: []int64{5, 4, 3},
+		},
+		{
+			name:     "v1 literals",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv1{r: r} },
+			encoded:  []byte{0xfb, 0x02, 0x03, 0x06, 0x07, 0x0b},
+			expected: []int64{2, 3, 6, 7, 11},
+		},
+		{
+			name:     "v2 short repeat",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv2{r: r} },
+			encoded:  []byte{0x0a, 0x27, 0x10},
+			expected: []int64{10000, 10000, 10000, 10000, 10000},
+		},
+		{
+			name:     "v2 direct",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv2{r: r} },
+			encoded:  []byte{0x5e, 0x03, 0x5c, 0xa1, 0xab, 0x1e, 0xde, 0xad, 0xbe, 0xef},
+			expected: []int64{23713, 43806, 57005, 48879},
+		},
+		{
+			name: "v2 patched base",
+			ints: func(r *bufio.Reader) orcInts { return &orcRLEv2{r: r} },
+			encoded: []byte{
+				0x8e, 0x13, 0x2b, 0x21, 0x07, 0xd0, 0x1e, 0x00, 0x14, 0x70, 0x28, 0x32, 0x3c, 0x46,
+				0x50, 0x5a, 0x64, 0x6e, 0x78, 0x82, 0x8c, 0x96, 0xa0, 0xaa, 0xb4, 0xbe, 0xfc, 0xe8,
+			},
+			expected: []int64{2030, 2000, 2020, 1000000, 2040, 2050, 2060, 2070, 2080, 2090, 2100, 2110, 2120, 2130, 2140, 2150, 2160, 2170, 2180, 2190},
+		},
+		{
+			name:     "v2 delta",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv2{r: r} },
+			encoded:  []byte{0xc6, 0x09, 0x02, 0x02, 0x22, 0x42, 0x42, 0x46},
+			expected: []int64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29},
+		},
+		{
+			name:     "v2 signed fixed delta",
+			ints:     func(r *bufio.Reader) orcInts { return &orcRLEv2{r: r, signed: true} },
+			encoded:  []byte{0xc0, 0x03, 0x14, 0x03},
+			expected: []int64{10, 8, 6, 4},
+		},
+	}
+	for _, testcase := range testcases {
+		ints := testcase.ints(bufio.NewReader(bytes.NewReader(testcase.encoded)))
+		values := []int64{}
+		for range testcase.expected {
+			v, err := ints.next()
+			assert.Nil(t, err, testcase.name)
+			values = append(values, v)
+		}
+		assert.Equal(t, testcase.expected, values, testcase.name)
+		_, err := ints.next()
+		assert.NotNil(t, err, testcase.name)
+	}
+
+	// the bytes of a run and literals, read as booleans
+	bools := &orcBools{bytes: orcBytes{r: bufio.NewReader(bytes.NewReader([]byte{0x00, 0xff, 0xfe, 0x44, 0x45}))}}
+	values := []bool{}
+	for i := 0; i < 40; i++ {
+		v, err := bools.next()
+		assert.Nil(t, err)
+		values = append(values, v)
+	}
+	expected := []bool{}
+	for _, b := range []byte{0xff, 0xff, 0xff, 0x44, 0x45} {
+		for i := 7; i >= 0; i-- {
+			expected = append(expected, b>>uint(i)&1 == 1)
+		}
+	}
+	assert.Equal(t, expected, values)
+}
@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"encoding/csv"
+	"os"
+	"s3-kinesis-replay/validate"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Report implements a replay reporter that collects archive objects that
+// could not be downloaded, writing them to a report file in a format that can
+// be replayed as a keys file
+type Report struct {
+	// The failed objects as <bucket>,<key>,<error> rows
+	failed [][]string
+	// The report file path
+	file string
+	// A logger instance
+	log logrus.FieldLogger
+	// A mutex to synchronise report state
+	mu *sync.Mutex
+}
+
+// NewReport returns a new failed objects report
+func NewReport(c *ReportConfig) (*Report, error) {
+	// validate configuration
+	err := validate.V.Struct(c)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{
+		file: c.File,
+		log:  c.Log,
+		mu:   &sync.Mutex{},
+	}
+	return r, nil
+}
+
+// Failed records an archive object that could not be downloaded
+func (r *Report) Failed(bucket, key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, []string{bucket, key, err.Error()})
+}
+
+// Close writes the failed objects to the report file, which is left empty if
+// all objects were downloaded
+func (r *Report) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.Create(r.file)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(r.failed)
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if len(r.failed) > 0 {
+		r.log.WithFields(logrus.Fields{
+			"file":   r.file,
+			"failed": len(r.failed),
+		}).Warnln("failed objects reported")
+	}
+	return nil
+}
+
+// ReportConfig defines a failed objects report configuration
+type ReportConfig struct {
+	// The report file path
+	File string `validate:"required"`
+	// A report scoped logger
+	Log logrus.FieldLogger `validate:"required"`
+}
+
+// NewReportConfig returns a report config value with appropriate defaults
+func NewReportConfig() *ReportConfig {
+	return &ReportConfig{
+		Log: logrus.WithField("package", "s3"),
+	}
+}
@@ -0,0 +1,130 @@
+package s3
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+// supported archive restore modes
+const (
+	// RestoreWait restores archived objects and waits for each restore to
+	// complete before replaying the object
+	RestoreWait = "wait"
+	// RestoreOnly initiates restores of archived objects without replaying
+	// any objects
+	RestoreOnly = "only"
+)
+
+// errRestoreTimeout is returned when an object's restore has not completed
+// within the maximum restore wait
+var errRestoreTimeout = errors.New("restore did not complete within the maximum restore wait")
+
+// supported restore retrieval tiers
+var tiers = map[string]bool{
+	s3.TierBulk:      true,
+	s3.TierExpedited: true,
+	s3.TierStandard:  true,
+}
+
+// error codes returned by s3 for archived objects and restores
+const (
+	errCodeInvalidObjectState       = "InvalidObjectState"
+	errCodeRestoreAlreadyInProgress = "RestoreAlreadyInProgress"
+)
+
+// archived determines whether an object must be restored before it can be
+// downloaded
+func archived(o *s3.Object) bool {
+	switch aws.StringValue(o.StorageClass) {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return true
+	}
+	return false
+}
+
+// restore initiates a restore of an archived object, treating a restore that
+// is already in progress as success
+func (a *Archive) restore(o *s3.Object) error {
+	input := &s3.RestoreObjectInput{
+		Bucket:       a.bucket,
+		Key:          o.Key,
+		RequestPayer: a.requestPayer,
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(a.restoreDays),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(a.restoreTier),
+			},
+		},
+	}
+	if !a.asOf.IsZero() {
+		input.VersionId = a.version(o)
+	}
+	_, err := a.client.RestoreObject(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeRestoreAlreadyInProgress {
+		return nil
+	}
+	if err == nil {
+		a.log.WithFields(logrus.Fields{
+			"class": aws.StringValue(o.StorageClass),
+			"key":   *o.Key,
+			"tier":  a.restoreTier,
+		}).Debugln("restore initiated")
+	}
+	return err
+}
+
+// waitRestored polls an archived object until its restore has completed,
+// initiating a restore if none is in progress, or until the maximum restore
+// wait has elapsed
+func (a *Archive) waitRestored(o *s3.Object) error {
+	logged := false
+	deadline := time.Now().Add(a.restoreMaxWait)
+	for {
+		var versionID *string
+		if !a.asOf.IsZero() {
+			versionID = a.version(o)
+		}
+		output, err := a.headObject(o.Key, versionID)
+		if err != nil {
+			return err
+		}
+		status := aws.StringValue(output.Restore)
+		switch {
+		case strings.Contains(status, `ongoing-request="false"`):
+			if logged {
+				a.log.WithField("key", *o.Key).Infoln("restore complete")
+			}
+			return nil
+		case status == "":
+			if err := a.restore(o); err != nil {
+				return err
+			}
+		}
+		if !logged {
+			a.log.WithFields(logrus.Fields{
+				"interval": a.restoreInterval,
+				"key":      *o.Key,
+			}).Infoln("waiting for restore")
+			logged = true
+		}
+		if time.Now().Add(a.restoreInterval).After(deadline) {
+			return errRestoreTimeout
+		}
+		time.Sleep(a.restoreInterval)
+	}
+}
+
+// archivedError returns a descriptive error if a download failed because the
+// object is archived and restores are disabled
+func archivedError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeInvalidObjectState {
+		return errors.New("object is archived and must be restored before it can be replayed: " + aerr.Message())
+	}
+	return nil
+}
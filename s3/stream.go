@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/cenkalti/backoff"
+)
+
+// rangeReader streams an s3 object using concurrent ranged GETs, buffering at
+// most a fixed number of parts ahead of the reader
+type rangeReader struct {
+	// the data of the part currently being read
+	current io.Reader
+	// closed when the reader is closed to stop scheduling parts
+	done chan struct{}
+	// guards against closing done more than once
+	once *sync.Once
+	// an ordered queue of pending part results
+	parts chan chan *part
+	// returns a new retry policy for each part
+	retry func() backoff.BackOff
+	// notified of each failed part attempt that will be retried
+	notify backoff.Notify
+}
+
+// part describes the result of a single ranged GET
+type part struct {
+	data []byte
+	err  error
+}
+
+// newRangeReader begins fetching an object in parts of the given size, with
+// at most concurrency parts downloading or buffered at any time. The first
+// part is fetched synchronously so that request errors and object metadata
+// are available immediately, and is retried by the caller. Each remaining
+// part is retried with its own policy, including when its body fails partway
+// through.
+func newRangeReader(client s3iface.S3API, input *s3.GetObjectInput, size, partSize int64, concurrency int, retry func() backoff.BackOff, notify backoff.Notify) (*rangeReader, *s3.GetObjectOutput, error) {
+	first, output, err := getRange(client, input, 0, partSize, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &rangeReader{
+		current: bytes.NewReader(first),
+		done:    make(chan struct{}),
+		once:    &sync.Once{},
+		parts:   make(chan chan *part, concurrency),
+		retry:   retry,
+		notify:  notify,
+	}
+	go r.schedule(client, input, size, partSize)
+	return r, output, nil
+}
+
+// schedule queues the remaining parts in order, fetching them concurrently
+// as space in the queue becomes available
+func (r *rangeReader) schedule(client s3iface.S3API, input *s3.GetObjectInput, size, partSize int64) {
+	defer close(r.parts)
+	for start := partSize; start < size; start += partSize {
+		result := make(chan *part, 1)
+		select {
+		case r.parts <- result:
+		case <-r.done:
+			return
+		}
+		go func(start int64) {
+			var data []byte
+			err := backoff.RetryNotify(func() error {
+				var err error
+				data, _, err = getRange(client, input, start, partSize, size)
+				return err
+			}, r.retry(), r.notify)
+			result <- &part{data: data, err: err}
+		}(start)
+	}
+}
+
+// Read implements io.Reader
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		result, ok := <-r.parts
+		if !ok {
+			return 0, io.EOF
+		}
+		next := <-result
+		if next.err != nil {
+			return 0, next.err
+		}
+		r.current = bytes.NewReader(next.data)
+	}
+}
+
+// Close stops any further parts from being scheduled
+func (r *rangeReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return nil
+}
+
+// getRange downloads a single part of an object
+func getRange(client s3iface.S3API, input *s3.GetObjectInput, start, partSize, size int64) ([]byte, *s3.GetObjectOutput, error) {
+	end := start + partSize - 1
+	if end >= size {
+		end = size - 1
+	}
+	params := *input
+	params.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+	output, err := client.GetObject(&params)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, output, nil
+}
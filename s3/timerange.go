@@ -0,0 +1,46 @@
+package s3
+
+import (
+	"regexp"
+	"time"
+)
+
+// DefaultKeyTemplate is the time layout of the date-partitioned prefix that
+// firehose appends to delivered object keys (YYYY/MM/DD/HH/)
+const DefaultKeyTemplate = "2006/01/02/15/"
+
+// firehoseTimestamp matches the delivery timestamp embedded in default
+// firehose object names (e.g. stream-1-2018-01-03-04-12-31-<uuid>)
+var firehoseTimestamp = regexp.MustCompile(`-(\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2})-`)
+
+// TimePrefixes returns the ordered set of distinct key prefixes produced by
+// formatting every hour in the range [from, to) with the given time layout
+// and appending it to the base prefix
+func TimePrefixes(base, template string, from, to time.Time) []string {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+	prefixes := []string{}
+	for t := from.UTC().Truncate(time.Hour); t.Before(to); t = t.Add(time.Hour) {
+		prefix := base + t.Format(template)
+		if n := len(prefixes); n > 0 && prefixes[n-1] == prefix {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// keyTime extracts the firehose delivery timestamp from an object key,
+// returning false if the key does not contain one
+func keyTime(key string) (time.Time, bool) {
+	m := firehoseTimestamp.FindStringSubmatch(key)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006-01-02-15-04-05", m[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,127 @@
+package s3
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// version describes a single object version or delete marker
+type version struct {
+	deleteMarker bool
+	object       *s3.Object
+	versionID    *string
+}
+
+// versionSelector selects the version of each key that was current at a
+// point in time from a stream of listed versions, which are ordered by key
+// and then from newest to oldest
+type versionSelector struct {
+	// the point in time
+	asOf time.Time
+	// the key currently being listed
+	key string
+	// whether a version has been selected for the current key
+	selected bool
+}
+
+// page returns the selected versions within a page of listed versions,
+// omitting keys that did not exist or had been deleted at the point in time
+func (s *versionSelector) page(output *s3.ListObjectVersionsOutput) []*version {
+	versions := make([]*version, 0, len(output.Versions)+len(output.DeleteMarkers))
+	for _, v := range output.Versions {
+		versions = append(versions, &version{
+			object: &s3.Object{
+				ETag:         v.ETag,
+				Key:          v.Key,
+				LastModified: v.LastModified,
+				Size:         v.Size,
+				StorageClass: v.StorageClass,
+			},
+			versionID: v.VersionId,
+		})
+	}
+	for _, d := range output.DeleteMarkers {
+		versions = append(versions, &version{
+			deleteMarker: true,
+			object: &s3.Object{
+				Key:          d.Key,
+				LastModified: d.LastModified,
+			},
+			versionID: d.VersionId,
+		})
+	}
+	// versions and delete markers are listed separately, so restore their
+	// combined order
+	sort.SliceStable(versions, func(i, j int) bool {
+		ki, kj := *versions[i].object.Key, *versions[j].object.Key
+		if ki != kj {
+			return ki < kj
+		}
+		return aws.TimeValue(versions[i].object.LastModified).After(aws.TimeValue(versions[j].object.LastModified))
+	})
+	selected := []*version{}
+	for _, v := range versions {
+		if *v.object.Key != s.key {
+			s.key = *v.object.Key
+			s.selected = false
+		}
+		if s.selected || aws.TimeValue(v.object.LastModified).After(s.asOf) {
+			continue
+		}
+		s.selected = true
+		if !v.deleteMarker {
+			selected = append(selected, v)
+		}
+	}
+	return selected
+}
+
+// scanVersions recursively lists the versions of objects within the
+// configured prefixes and queues the version of each key that was current at
+// the as of time
+func (a *Archive) scanVersions(pending chan *s3.Object) error {
+	stopped := false
+	for _, prefix := range a.scanPrefixes() {
+		// define list object version parameters
+		params := &s3.ListObjectVersionsInput{
+			Bucket:    a.bucket,
+			KeyMarker: a.startAfter,
+			Prefix:    prefix,
+		}
+		selector := &versionSelector{asOf: a.asOf}
+		// scan through version pages
+		err := a.client.ListObjectVersionsPages(params, func(output *s3.ListObjectVersionsOutput, more bool) bool {
+			for _, v := range selector.page(output) {
+				if !a.queue(v.object, v.versionID, pending) {
+					stopped = true
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			break
+		}
+	}
+	return nil
+}
+
+// version returns the version of a queued object to download, if any
+func (a *Archive) version(o *s3.Object) *string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.versions[o]
+}
+
+// forget discards the version of an object once it has been downloaded
+func (a *Archive) forget(o *s3.Object) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.versions, o)
+}